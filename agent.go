@@ -0,0 +1,634 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Node agent settings (see 'agent' subcommand flags).
+type agentConfig struct {
+	ControllerUrl string
+	Listen        string
+	ConfDir       string
+	StateDir      string
+	Group         string
+	Labels        string
+	Token         string
+	ValidateCmd   string
+	ReloadCmd     string
+	RegInterval   time.Duration
+	TlsCert       string
+	TlsKey        string
+	TlsCa         string
+	TrustedKeys   string
+	// Public keys to verify packages signatures by key id, empty - signatures are not checked.
+	Keys map[string]ed25519.PublicKey
+	// Controller http client (with node certificate if set).
+	Client *http.Client
+}
+
+// Loaded config version, served on /config_version.
+var agentVersion int
+var agentVersionLock sync.Mutex
+
+// Run node agent: register on controller, wait for new versions, apply packages and report results.
+func runAgent(args []string) {
+	fs := flag.NewFlagSet("agent", flag.ExitOnError)
+	conf := agentConfig{}
+	fs.StringVar(&conf.ControllerUrl, "controller.url",
+		getEnv("AGENT_CONTROLLER_URL", "http://127.0.0.1:8081"),
+		"Controller base url.")
+	fs.StringVar(&conf.Listen, "listen",
+		getEnv("AGENT_LISTEN", ":80"),
+		"Listen address for /config_version endpoint, controller requests it on port 80.")
+	fs.StringVar(&conf.ConfDir, "conf.dir",
+		getEnv("AGENT_CONF_DIR", "/etc/nginx/conf.d"),
+		"Nginx configs directory, package is extracted here.")
+	fs.StringVar(&conf.StateDir, "state.dir",
+		getEnv("AGENT_STATE_DIR", "/var/lib/lb-agent"),
+		"Directory for loaded version, last good config and downloads.")
+	fs.StringVar(&conf.Group, "group",
+		getEnv("AGENT_GROUP", ""),
+		"Node group name.")
+	fs.StringVar(&conf.Labels, "labels",
+		getEnv("AGENT_LABELS", ""),
+		"Node labels for group selectors, format 'key1=val1,key2=val2'.")
+	fs.StringVar(&conf.Token, "token",
+		getEnv("AGENT_TOKEN", ""),
+		"Controller API token (node role).")
+	fs.StringVar(&conf.ValidateCmd, "validate.cmd",
+		getEnv("AGENT_VALIDATE_CMD", "nginx -t"),
+		"Shell command to validate configs.")
+	fs.StringVar(&conf.ReloadCmd, "reload.cmd",
+		getEnv("AGENT_RELOAD_CMD", "nginx -s reload"),
+		"Shell command to reload nginx.")
+	fs.DurationVar(&conf.RegInterval, "reg.interval",
+		time.Duration(getEnvInt64("AGENT_REG_INTERVAL", 30))*time.Second,
+		"Registration interval.")
+	fs.StringVar(&conf.TlsCert, "tls.cert",
+		getEnv("AGENT_TLS_CERT", ""),
+		"Node client certificate for controller mTLS.")
+	fs.StringVar(&conf.TlsKey, "tls.key",
+		getEnv("AGENT_TLS_KEY", ""),
+		"Node client certificate key.")
+	fs.StringVar(&conf.TlsCa, "tls.ca",
+		getEnv("AGENT_TLS_CA", ""),
+		"CA bundle to verify controller certificate. Empty - system CAs.")
+	fs.StringVar(&conf.TrustedKeys, "sign.trusted.file",
+		getEnv("AGENT_SIGN_TRUSTED_FILE", ""),
+		"JSON file with trusted ed25519 public keys. Set - unsigned packages are rejected.")
+	fs.Parse(args)
+
+	if conf.TrustedKeys != "" {
+		keys, err := loadTrustedKeys(conf.TrustedKeys)
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
+		conf.Keys = keys
+	}
+
+	client, err := agentHttpClient(conf)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	conf.Client = client
+
+	err = os.MkdirAll(conf.StateDir, os.FileMode(0755))
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	setAgentVersion(readAgentVersion(conf))
+	log.Printf("Agent started, loaded config version: %d", getAgentVersion())
+
+	go agentListen(conf)
+	go agentRegisterLoop(conf)
+	agentWatchLoop(conf)
+}
+
+// Get loaded config version.
+func getAgentVersion() int {
+	agentVersionLock.Lock()
+	defer agentVersionLock.Unlock()
+	return agentVersion
+}
+
+// Set loaded config version.
+func setAgentVersion(version int) {
+	agentVersionLock.Lock()
+	defer agentVersionLock.Unlock()
+	agentVersion = version
+}
+
+// Read loaded version saved in state dir.
+func readAgentVersion(conf agentConfig) int {
+	data, err := ioutil.ReadFile(filepath.Join(conf.StateDir, "version"))
+	if err != nil {
+		return 0
+	}
+	version, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	return version
+}
+
+// Serve /config_version for controller.
+func agentListen(conf agentConfig) {
+	router := http.NewServeMux()
+	router.HandleFunc("/config_version", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strconv.Itoa(getAgentVersion())))
+	})
+	log.Printf("Runing agent listener on %s", conf.Listen)
+	log.Fatal(http.ListenAndServe(conf.Listen, router))
+}
+
+// Register on controller periodically, node is removed from controller list if unseen.
+func agentRegisterLoop(conf agentConfig) {
+	regUrl := fmt.Sprintf("%s/reg?group=%s&labels=%s", conf.ControllerUrl, url.QueryEscape(conf.Group), url.QueryEscape(conf.Labels))
+	for {
+		resp, err := agentRequest(conf, http.MethodGet, regUrl, nil)
+		if err != nil {
+			log.Printf("Registration error: %s", err.Error())
+		} else {
+			resp.Body.Close()
+		}
+		agentCheckDrift(conf)
+		time.Sleep(conf.RegInterval)
+	}
+}
+
+// Wait for new versions on controller /watch and apply them.
+func agentWatchLoop(conf agentConfig) {
+	for {
+		resp, err := agentRequest(conf, http.MethodGet, fmt.Sprintf("%s/watch?ver=%d", conf.ControllerUrl, getAgentVersion()), nil)
+		if err != nil {
+			log.Printf("Watch error: %s", err.Error())
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		if resp.StatusCode == http.StatusNoContent {
+			resp.Body.Close()
+			continue
+		}
+		var watchResp watchResponse
+		err = json.NewDecoder(resp.Body).Decode(&watchResp)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || err != nil {
+			log.Printf("Bad watch response, status: %s", resp.Status)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		err = agentApply(conf, watchResp.Version, conf.ControllerUrl+watchResp.Url)
+		if err != nil {
+			log.Printf("Version %d apply error: %s", watchResp.Version, err.Error())
+			// Do not retry broken version too often.
+			time.Sleep(30 * time.Second)
+		}
+	}
+}
+
+// Download, extract, validate and reload config version. Restore last good config on failure.
+func agentApply(conf agentConfig, version int, pkgUrl string) error {
+	stagingDir := filepath.Join(conf.StateDir, "staging")
+	goodDir := filepath.Join(conf.StateDir, "good")
+	os.RemoveAll(stagingDir)
+	defer os.RemoveAll(stagingDir)
+
+	// Ask for zstd package and delta from loaded version (group of loaded version is in its manifest).
+	// Controller sends gzip or full package if they are not available.
+	fullUrl := pkgUrl + "&format=" + formatZstd
+	requestUrl := fullUrl
+	if current := getAgentVersion(); current > 0 {
+		if group := loadedManifestGroup(conf); group != "" {
+			requestUrl = fmt.Sprintf("%s&from=%d&from_group=%s", fullUrl, current, url.QueryEscape(group))
+		}
+	}
+	manifestData, delta, err := agentStagePackage(conf, version, requestUrl, stagingDir)
+	if err != nil && delta {
+		// Delta is applied to current configs, they could be changed locally. Full package doesn't depend on them.
+		log.Printf("Delta package of version %d failed, downloading full package: %s", version, err.Error())
+		os.RemoveAll(stagingDir)
+		manifestData, _, err = agentStagePackage(conf, version, fullUrl, stagingDir)
+	}
+	if err != nil {
+		return err
+	}
+	// Current config was applied successfully, keep it as last good.
+	os.RemoveAll(goodDir)
+	err = copyDir(conf.ConfDir, goodDir)
+	if err != nil {
+		return err
+	}
+	err = replaceDirContent(conf.ConfDir, stagingDir)
+	if err != nil {
+		return err
+	}
+	report := nodeReport{Version: version}
+	output, err := runShellCmd(conf.ValidateCmd)
+	if err == nil {
+		// Report validate output, reload output is added to it.
+		var reloadOutput string
+		reloadOutput, err = runShellCmd(conf.ReloadCmd)
+		output += reloadOutput
+	}
+	report.TestOutput = output
+	if err != nil {
+		log.Printf("Version %d failed, restoring last good config: %s", version, output)
+		if restoreErr := replaceDirContent(conf.ConfDir, goodDir); restoreErr != nil {
+			log.Printf("Can't restore last good config: %s", restoreErr.Error())
+		} else if out, reloadErr := runShellCmd(conf.ReloadCmd); reloadErr != nil {
+			log.Printf("Can't reload last good config: %s", out)
+		}
+		report.ConfHash, _ = dirHash(conf.ConfDir)
+		agentReport(conf, report)
+		return err
+	}
+	report.TestOk = true
+	report.ReloadTime = time.Now().Unix()
+	report.ConfHash, _ = dirHash(conf.ConfDir)
+	err = ioutil.WriteFile(filepath.Join(conf.StateDir, "version"), []byte(strconv.Itoa(version)), os.FileMode(0644))
+	if err != nil {
+		log.Printf("Can't save loaded version: %s", err.Error())
+	}
+	// Manifest of loaded version for drift check.
+	os.Remove(filepath.Join(conf.StateDir, manifestName))
+	if manifestData != nil {
+		ioutil.WriteFile(filepath.Join(conf.StateDir, manifestName), manifestData, os.FileMode(0644))
+	}
+	setAgentVersion(version)
+	log.Printf("Config version %d loaded.", version)
+	agentReport(conf, report)
+	return nil
+}
+
+// Download package, check signature, extract it to staging dir and check files by manifest.
+// Return manifest data and true if delta package was sent.
+func agentStagePackage(conf agentConfig, version int, pkgUrl, stagingDir string) ([]byte, bool, error) {
+	resp, err := agentRequest(conf, http.MethodGet, pkgUrl, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("package download failed, status: %s", resp.Status)
+	}
+	pkg, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, err
+	}
+	if conf.Keys != nil {
+		if err = verifySignature(pkg, controllerHeader(resp, signatureHeader), conf.Keys); err != nil {
+			return nil, false, fmt.Errorf("package signature check failed: %s", err.Error())
+		}
+	}
+	delta := controllerHeader(resp, deltaFromHeader) != ""
+	if delta {
+		err = extractDelta(bytes.NewReader(pkg), conf.ConfDir, stagingDir)
+	} else {
+		err = extractPackage(bytes.NewReader(pkg), stagingDir)
+	}
+	if err != nil {
+		return nil, delta, err
+	}
+	manifestData, err := verifyStagingManifest(conf, version, stagingDir)
+	return manifestData, delta, err
+}
+
+// Group of loaded version from its saved manifest, empty if unknown.
+func loadedManifestGroup(conf agentConfig) string {
+	data, err := ioutil.ReadFile(filepath.Join(conf.StateDir, manifestName))
+	if err != nil {
+		return ""
+	}
+	manifest, err := parseManifest(data)
+	if err != nil {
+		return ""
+	}
+	return manifest.Group
+}
+
+// Check extracted files against package manifest and remove manifest from configs.
+// Manifest must be of requested version and node group, so old signed package can't be replayed.
+// Return manifest data, nil if package has no manifest (allowed only without trusted keys).
+func verifyStagingManifest(conf agentConfig, version int, stagingDir string) ([]byte, error) {
+	manifestPath := filepath.Join(stagingDir, manifestName)
+	data, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			if conf.Keys != nil {
+				return nil, fmt.Errorf("package has no manifest, it's required with trusted keys")
+			}
+			log.Println("Package has no manifest, files are not checked.")
+			return nil, nil
+		}
+		return nil, err
+	}
+	manifest, err := parseManifest(data)
+	if err != nil {
+		return nil, fmt.Errorf("bad package manifest: %s", err.Error())
+	}
+	if manifest.Version != version {
+		return nil, fmt.Errorf("package manifest is of version %d, requested %d", manifest.Version, version)
+	}
+	// Without group flag node group is chosen by controller.
+	if conf.Group != "" && manifest.Group != conf.Group {
+		return nil, fmt.Errorf("package manifest is of group '%s', node group is '%s'", manifest.Group, conf.Group)
+	}
+	if err = os.Remove(manifestPath); err != nil {
+		return nil, err
+	}
+	drift, err := manifestDrift(manifest, stagingDir)
+	if err != nil {
+		return nil, err
+	}
+	if len(drift) > 0 {
+		return nil, fmt.Errorf("package files don't match manifest: %s", strings.Join(drift, ", "))
+	}
+	return data, nil
+}
+
+// Compare configs dir with manifest of loaded version and log local changes.
+// Manifest is requested from controller if it's not saved.
+func agentCheckDrift(conf agentConfig) {
+	version := getAgentVersion()
+	if version == 0 {
+		return
+	}
+	manifestPath := filepath.Join(conf.StateDir, manifestName)
+	data, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		resp, err := agentRequest(conf, http.MethodGet, fmt.Sprintf("%s/getconf/manifest?ver=%d", conf.ControllerUrl, version), nil)
+		if err != nil {
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return
+		}
+		if data, err = ioutil.ReadAll(resp.Body); err != nil {
+			return
+		}
+		if conf.Keys != nil {
+			if err = verifySignature(data, resp.Header.Get(signatureHeader), conf.Keys); err != nil {
+				log.Printf("Manifest of version %d signature check failed: %s", version, err.Error())
+				return
+			}
+		}
+		ioutil.WriteFile(manifestPath, data, os.FileMode(0644))
+	}
+	manifest, err := parseManifest(data)
+	if err != nil {
+		log.Printf("Bad manifest of version %d: %s", version, err.Error())
+		return
+	}
+	drift, err := manifestDrift(manifest, conf.ConfDir)
+	if err != nil {
+		log.Printf("Drift check error: %s", err.Error())
+		return
+	}
+	if len(drift) > 0 {
+		log.Printf("Configs differ from version %d manifest: %s", version, strings.Join(drift, ", "))
+	}
+}
+
+// Send apply result to controller.
+func agentReport(conf agentConfig, report nodeReport) {
+	data, err := json.Marshal(report)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	resp, err := agentRequest(conf, http.MethodPost, conf.ControllerUrl+"/report", bytes.NewReader(data))
+	if err != nil {
+		log.Printf("Report error: %s", err.Error())
+		return
+	}
+	resp.Body.Close()
+}
+
+// Send request to controller with API token.
+func agentRequest(conf agentConfig, method, reqUrl string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, reqUrl, body)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+conf.Token)
+	}
+	return conf.Client.Do(req)
+}
+
+// Build controller http client with node certificate and controller CA.
+func agentHttpClient(conf agentConfig) (*http.Client, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if conf.TlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(conf.TlsCert, conf.TlsKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if conf.TlsCa != "" {
+		pool, err := loadCertPool(conf.TlsCa)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}, nil
+}
+
+// Response header, set by controller. Package could be downloaded from store by controller redirect,
+// then headers are in redirect response.
+func controllerHeader(resp *http.Response, name string) string {
+	for ; resp != nil; resp = resp.Request.Response {
+		if value := resp.Header.Get(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// Run shell command, return combined output.
+func runShellCmd(command string) (string, error) {
+	output, err := exec.Command("sh", "-c", command).CombinedOutput()
+	return string(output), err
+}
+
+// Extract tar.gz package to dir. Only regular files and dirs inside dir are allowed.
+func extractPackage(pkg io.Reader, dir string) error {
+	zr, err := decompress(pkg)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		target, err := safeExtractPath(dir, header.Name)
+		if err != nil {
+			return err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, os.FileMode(0755))
+		case tar.TypeReg:
+			err = extractFile(tr, target, os.FileMode(header.Mode).Perm())
+		default:
+			err = fmt.Errorf("unsupported entry type in package: %s", header.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Apply delta package to copy of current configs in dir.
+func extractDelta(pkg io.Reader, currentDir, dir string) error {
+	err := copyDir(currentDir, dir)
+	if err != nil {
+		return err
+	}
+	err = extractPackage(pkg, dir)
+	if err != nil {
+		return err
+	}
+	deletedFile := filepath.Join(dir, deltaDeletedName)
+	data, err := ioutil.ReadFile(deletedFile)
+	if err != nil {
+		return fmt.Errorf("bad delta package: %s", err.Error())
+	}
+	for _, name := range splitLines(string(data)) {
+		target, err := safeExtractPath(dir, name)
+		if err != nil {
+			return err
+		}
+		if err = os.Remove(target); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Remove(deletedFile)
+}
+
+// Get extract path for package entry, reject absolute paths and paths out of dir.
+func safeExtractPath(dir, name string) (string, error) {
+	cleanName := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(cleanName) || cleanName == ".." || strings.HasPrefix(cleanName, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("bad path in package: %s", name)
+	}
+	return filepath.Join(dir, cleanName), nil
+}
+
+// Write file from reader.
+func extractFile(src io.Reader, target string, mode os.FileMode) error {
+	err := os.MkdirAll(filepath.Dir(target), os.FileMode(0755))
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(file, src); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	// Mode is checked by manifest, it must not depend on agent umask.
+	return os.Chmod(target, mode)
+}
+
+// Copy directory recursively.
+func copyDir(src, dst string) error {
+	return filepath.Walk(src, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, file)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if fi.IsDir() {
+			return os.MkdirAll(target, fi.Mode().Perm())
+		}
+		if err = copyFile(file, target); err != nil {
+			return err
+		}
+		return os.Chmod(target, fi.Mode().Perm())
+	})
+}
+
+// Replace all dir content by src dir content. Dir itself is kept (it can be a mount point).
+func replaceDirContent(dir, src string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, entry := range entries {
+		if err = os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return copyDir(src, dir)
+}
+
+// sha256 of dir content: relative paths and files data in sorted order.
+func dirHash(dir string) (string, error) {
+	var files []string
+	err := filepath.Walk(dir, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			files = append(files, file)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(files)
+	hash := sha256.New()
+	for _, file := range files {
+		rel, _ := filepath.Rel(dir, file)
+		hash.Write([]byte(filepath.ToSlash(rel) + "\x00"))
+		data, err := os.Open(file)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(hash, data)
+		data.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+// Fake controller: serves one package on /getconf and collects node reports.
+type testController struct {
+	server  *httptest.Server
+	pkg     []byte
+	headers map[string]string
+	lock    sync.Mutex
+	reports []nodeReport
+}
+
+func newTestController(t *testing.T, pkg []byte) *testController {
+	c := &testController{pkg: pkg, headers: make(map[string]string)}
+	c.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/getconf":
+			for name, value := range c.headers {
+				w.Header().Set(name, value)
+			}
+			w.Write(c.pkg)
+		case "/report":
+			var report nodeReport
+			if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			c.lock.Lock()
+			c.reports = append(c.reports, report)
+			c.lock.Unlock()
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(c.server.Close)
+	return c
+}
+
+func (c *testController) getReports() []nodeReport {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]nodeReport(nil), c.reports...)
+}
+
+// Write files to dir, names are relative to dir.
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Read all files of dir, names are relative to dir.
+func readTestFiles(t *testing.T, dir string) map[string]string {
+	files := make(map[string]string)
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		files[filepath.ToSlash(rel)] = string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// Build gzip package with manifest the way controller does.
+func testPackage(t *testing.T, version int, group string, files map[string]string) []byte {
+	src := t.TempDir()
+	writeTestFiles(t, src, files)
+	return testPackageDir(t, version, group, src)
+}
+
+// Package of version made from src dir.
+func testPackageDir(t *testing.T, version int, group, src string) []byte {
+	manifest, err := buildManifest(version, group, src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestData, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := filepath.Join(t.TempDir(), fmt.Sprint(version))
+	if err = compress(src, prefix, manifestData); err != nil {
+		t.Fatal(err)
+	}
+	pkg, err := ioutil.ReadFile(prefix + packageExts[formatGzip])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkg
+}
+
+// Agent config with temp dirs and fake nginx commands.
+// Validate command fails if configs contain 'broken', reload command logs reloads to state dir.
+func testAgentConfig(t *testing.T, controller *testController) agentConfig {
+	setAgentVersion(0)
+	t.Cleanup(func() { setAgentVersion(0) })
+	conf := agentConfig{
+		ControllerUrl: controller.server.URL,
+		ConfDir:       t.TempDir(),
+		StateDir:      t.TempDir(),
+		Client:        controller.server.Client(),
+	}
+	conf.ValidateCmd = fmt.Sprintf("if grep -rq broken %s; then echo 'nginx: [emerg] broken config'; exit 1; fi; echo 'nginx: test is successful'", conf.ConfDir)
+	conf.ReloadCmd = fmt.Sprintf("echo reload >> %s", filepath.Join(conf.StateDir, "reloads"))
+	return conf
+}
+
+func testReloads(t *testing.T, conf agentConfig) int {
+	data, err := ioutil.ReadFile(filepath.Join(conf.StateDir, "reloads"))
+	if os.IsNotExist(err) {
+		return 0
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Count(string(data), "reload")
+}
+
+func TestAgentApplySuccess(t *testing.T) {
+	controller := newTestController(t, testPackage(t, 5, "default", map[string]string{
+		"site.conf":      "server { listen 80; }",
+		"sites/api.conf": "server { listen 8080; }",
+	}))
+	conf := testAgentConfig(t, controller)
+	writeTestFiles(t, conf.ConfDir, map[string]string{"old.conf": "server { listen 81; }"})
+
+	if err := agentApply(conf, 5, controller.server.URL+"/getconf?ver=5"); err != nil {
+		t.Fatalf("apply failed: %s", err)
+	}
+	files := readTestFiles(t, conf.ConfDir)
+	if len(files) != 2 || files["site.conf"] != "server { listen 80; }" || files["sites/api.conf"] != "server { listen 8080; }" {
+		t.Fatalf("unexpected configs after apply: %v", files)
+	}
+	if good := readTestFiles(t, filepath.Join(conf.StateDir, "good")); good["old.conf"] != "server { listen 81; }" {
+		t.Fatalf("previous config is not kept as good: %v", good)
+	}
+	if getAgentVersion() != 5 || readAgentVersion(conf) != 5 {
+		t.Fatalf("loaded version: %d, saved version: %d", getAgentVersion(), readAgentVersion(conf))
+	}
+	if _, err := os.Stat(filepath.Join(conf.StateDir, manifestName)); err != nil {
+		t.Fatalf("manifest of loaded version is not saved: %s", err)
+	}
+	if reloads := testReloads(t, conf); reloads != 1 {
+		t.Fatalf("reloads: %d", reloads)
+	}
+}
+
+// Mode of extracted file doesn't depend on agent umask, manifest check accepts it.
+func TestAgentApplyFileMode(t *testing.T) {
+	src := t.TempDir()
+	writeTestFiles(t, src, map[string]string{"site.conf": "server { listen 80; }"})
+	if err := os.Chmod(filepath.Join(src, "site.conf"), 0664); err != nil {
+		t.Fatal(err)
+	}
+	controller := newTestController(t, testPackageDir(t, 5, "default", src))
+	conf := testAgentConfig(t, controller)
+	oldUmask := syscall.Umask(022)
+	defer syscall.Umask(oldUmask)
+
+	if err := agentApply(conf, 5, controller.server.URL+"/getconf?ver=5"); err != nil {
+		t.Fatalf("apply failed: %s", err)
+	}
+	info, err := os.Stat(filepath.Join(conf.ConfDir, "site.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0664 {
+		t.Fatalf("extracted file mode %o", info.Mode().Perm())
+	}
+}
+
+func TestAgentApplyValidateFailure(t *testing.T) {
+	controller := newTestController(t, testPackage(t, 6, "default", map[string]string{
+		"site.conf": "server { broken }",
+	}))
+	conf := testAgentConfig(t, controller)
+	writeTestFiles(t, conf.ConfDir, map[string]string{"site.conf": "server { listen 80; }"})
+	writeTestFiles(t, conf.StateDir, map[string]string{"version": "4"})
+	setAgentVersion(4)
+
+	if err := agentApply(conf, 6, controller.server.URL+"/getconf?ver=6"); err == nil {
+		t.Fatal("broken config is applied")
+	}
+	// Config is restored from good/ and reloaded.
+	files := readTestFiles(t, conf.ConfDir)
+	if len(files) != 1 || files["site.conf"] != "server { listen 80; }" {
+		t.Fatalf("config is not restored: %v", files)
+	}
+	if good := readTestFiles(t, filepath.Join(conf.StateDir, "good")); good["site.conf"] != "server { listen 80; }" {
+		t.Fatalf("good config changed: %v", good)
+	}
+	if reloads := testReloads(t, conf); reloads != 1 {
+		t.Fatalf("reloads: %d", reloads)
+	}
+	if getAgentVersion() != 4 || readAgentVersion(conf) != 4 {
+		t.Fatalf("loaded version changed: %d, saved: %d", getAgentVersion(), readAgentVersion(conf))
+	}
+	reports := controller.getReports()
+	if len(reports) != 1 || reports[0].Version != 6 || reports[0].TestOk || !strings.Contains(reports[0].TestOutput, "[emerg] broken config") {
+		t.Fatalf("unexpected reports: %+v", reports)
+	}
+}
+
+func TestAgentApplyPathTraversal(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	for name, data := range map[string]string{"../evil.conf": "evil", "site.conf": "server { listen 80; }"} {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg})
+		tw.Write([]byte(data))
+	}
+	tw.Close()
+	zw.Close()
+	controller := newTestController(t, buf.Bytes())
+	conf := testAgentConfig(t, controller)
+	writeTestFiles(t, conf.ConfDir, map[string]string{"site.conf": "server { listen 81; }"})
+
+	err := agentApply(conf, 7, controller.server.URL+"/getconf?ver=7")
+	if err == nil || !strings.Contains(err.Error(), "bad path") {
+		t.Fatalf("package with path out of dir is not rejected: %v", err)
+	}
+	// Staging dir is <state>/staging, escaped entry would be written to state dir.
+	if _, err := os.Stat(filepath.Join(conf.StateDir, "evil.conf")); !os.IsNotExist(err) {
+		t.Fatal("file out of staging dir is written")
+	}
+	if files := readTestFiles(t, conf.ConfDir); len(files) != 1 || files["site.conf"] != "server { listen 81; }" {
+		t.Fatalf("configs changed: %v", files)
+	}
+	if reloads := testReloads(t, conf); reloads != 0 {
+		t.Fatalf("reloads: %d", reloads)
+	}
+}
+
+func TestAgentApplyReport(t *testing.T) {
+	controller := newTestController(t, testPackage(t, 8, "default", map[string]string{
+		"site.conf": "server { listen 80; }",
+	}))
+	conf := testAgentConfig(t, controller)
+
+	if err := agentApply(conf, 8, controller.server.URL+"/getconf?ver=8"); err != nil {
+		t.Fatalf("apply failed: %s", err)
+	}
+	reports := controller.getReports()
+	if len(reports) != 1 {
+		t.Fatalf("reports: %+v", reports)
+	}
+	report := reports[0]
+	hash, err := dirHash(conf.ConfDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Version != 8 || !report.TestOk || report.ConfHash != hash || report.ReloadTime == 0 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	if !strings.Contains(report.TestOutput, "test is successful") {
+		t.Fatalf("report has no validate output: %q", report.TestOutput)
+	}
+}
+
+func TestAgentApplyReplay(t *testing.T) {
+	public, private := testKey(t)
+	keys := map[string]ed25519.PrivateKey{"key1": private}
+	noManifest := func() []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(zw)
+		data := "server { listen 80; }"
+		tw.WriteHeader(&tar.Header{Name: "site.conf", Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg})
+		tw.Write([]byte(data))
+		tw.Close()
+		zw.Close()
+		return buf.Bytes()
+	}()
+	files := map[string]string{"site.conf": "server { listen 80; }"}
+	tests := []struct {
+		name   string
+		pkg    []byte
+		group  string
+		signed bool
+		error  string
+	}{
+		{"signed package of requested version", testPackage(t, 9, "default", files), "", true, ""},
+		{"node group matches", testPackage(t, 9, "edge", files), "edge", true, ""},
+		{"old version replayed", testPackage(t, 5, "default", files), "", true, "of version 5, requested 9"},
+		{"other group", testPackage(t, 9, "default", files), "edge", true, "of group 'default'"},
+		{"no manifest with keys", noManifest, "", true, "has no manifest"},
+		{"no manifest without keys", noManifest, "", false, ""},
+		{"old version without keys", testPackage(t, 5, "default", files), "", false, "of version 5, requested 9"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			controller := newTestController(t, test.pkg)
+			conf := testAgentConfig(t, controller)
+			conf.Group = test.group
+			if test.signed {
+				conf.Keys = map[string]ed25519.PublicKey{"key1": public}
+				controller.headers[signatureHeader] = testSignature(test.pkg, []string{"key1"}, keys)
+			}
+			writeTestFiles(t, conf.ConfDir, map[string]string{"old.conf": "server { listen 81; }"})
+
+			err := agentApply(conf, 9, controller.server.URL+"/getconf?ver=9")
+			if test.error == "" {
+				if err != nil {
+					t.Fatalf("apply failed: %s", err)
+				}
+				if files := readTestFiles(t, conf.ConfDir); files["site.conf"] == "" {
+					t.Fatalf("configs are not applied: %v", files)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.error) {
+				t.Fatalf("error %v, want %q", err, test.error)
+			}
+			if files := readTestFiles(t, conf.ConfDir); len(files) != 1 || files["old.conf"] == "" {
+				t.Fatalf("configs changed: %v", files)
+			}
+			if reloads := testReloads(t, conf); reloads != 0 {
+				t.Fatalf("reloads: %d", reloads)
+			}
+		})
+	}
+}
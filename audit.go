@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var auditFile = flag.String("audit.file",
+	getEnv("AUDIT_FILE", ""),
+	"Append-only audit log of config changes. Empty - <conf.pkg.dir>/audit.log.")
+
+// Audit record of config pipeline run (JSON line in audit log).
+type auditRecord struct {
+	Time            int64             `json:"time"`
+	Trigger         string            `json:"trigger"`
+	Identity        string            `json:"identity"`
+	SourceIp        string            `json:"source_ip"`
+	JobId           string            `json:"job_id,omitempty"`
+	Version         int               `json:"version"`
+	MetadataHash    string            `json:"metadata_hash,omitempty"`
+	PackageHashes   map[string]string `json:"package_hashes,omitempty"`
+	ChangedProjects []string          `json:"changed_projects"`
+	ChangedDomains  []string          `json:"changed_domains"`
+	Outcome         string            `json:"outcome"`
+	Error           string            `json:"error,omitempty"`
+}
+
+var auditLock sync.Mutex
+
+// Metadata of last successful run, to find changed projects.
+var lastAuditMetadata projectsMetadataType
+
+// Audit log file name.
+func auditFileName() string {
+	if *auditFile != "" {
+		return *auditFile
+	}
+	return *configsPkgsDir + "/audit.log"
+}
+
+// Append record to audit log.
+func writeAudit(record auditRecord) {
+	record.Time = time.Now().Unix()
+	data, err := json.Marshal(record)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	file, err := os.OpenFile(auditFileName(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, os.FileMode(0600))
+	if err != nil {
+		log.Printf("Can't write audit log: %s", err.Error())
+		return
+	}
+	defer file.Close()
+	if _, err = file.Write(append(data, '\n')); err != nil {
+		log.Printf("Can't write audit log: %s", err.Error())
+		return
+	}
+	file.Sync()
+}
+
+// sha256 of projects metadata. JSON of maps has sorted keys, so hash is stable.
+func metadataHash(projects projectsMetadataType) string {
+	data, err := json.Marshal(projects)
+	if err != nil {
+		return ""
+	}
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// sha256 of file content.
+func fileHash(name string) (string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err = io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Package hash of each group for version.
+func packageHashes(version int) map[string]string {
+	hashes := make(map[string]string)
+	for _, group := range nodeGroupNames() {
+		hash, err := fileHash(fmt.Sprintf("%s/%d.tar.gz", groupDir(*configsPkgsDir, group), version))
+		if err != nil {
+			log.Printf("Can't get package hash: %s", err.Error())
+			continue
+		}
+		hashes[group] = hash
+	}
+	return hashes
+}
+
+// Projects and domains ('project/domain') added, removed or changed between metadata.
+func changedProjects(oldProjects, newProjects projectsMetadataType) (projects []string, domains []string) {
+	projects = []string{}
+	domains = []string{}
+	for uuid := range unionKeys(oldProjects, newProjects) {
+		oldProject, newProject := oldProjects[uuid], newProjects[uuid]
+		changed := oldProject == nil || newProject == nil
+		var oldDomains, newDomains map[string]*projectDomainData
+		if oldProject != nil {
+			oldDomains = oldProject.Domains
+		}
+		if newProject != nil {
+			newDomains = newProject.Domains
+		}
+		if !changed {
+			oldCopy, newCopy := *oldProject, *newProject
+			oldCopy.Domains, newCopy.Domains = nil, nil
+			changed = !reflect.DeepEqual(oldCopy, newCopy)
+		}
+		for domain := range unionDomains(oldDomains, newDomains) {
+			if !reflect.DeepEqual(oldDomains[domain], newDomains[domain]) {
+				domains = append(domains, uuid+"/"+domain)
+				changed = true
+			}
+		}
+		if changed {
+			projects = append(projects, uuid)
+		}
+	}
+	sort.Strings(projects)
+	sort.Strings(domains)
+	return projects, domains
+}
+
+// Keys of both projects maps.
+func unionKeys(a, b projectsMetadataType) map[string]bool {
+	keys := make(map[string]bool)
+	for key := range a {
+		keys[key] = true
+	}
+	for key := range b {
+		keys[key] = true
+	}
+	return keys
+}
+
+// Keys of both domains maps.
+func unionDomains(a, b map[string]*projectDomainData) map[string]bool {
+	keys := make(map[string]bool)
+	for key := range a {
+		keys[key] = true
+	}
+	for key := range b {
+		keys[key] = true
+	}
+	return keys
+}
+
+// Fill audit record with metadata changes since last successful run.
+func auditMetadata(record *auditRecord, projects projectsMetadataType) {
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	record.MetadataHash = metadataHash(projects)
+	record.ChangedProjects, record.ChangedDomains = changedProjects(lastAuditMetadata, projects)
+}
+
+// Remember metadata of successful run as base for next changes list.
+func setAuditBaseline(projects projectsMetadataType) {
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	lastAuditMetadata = projects
+}
+
+// Load changes base from metadata snapshot of latest version in history,
+// so first update after restart lists only real changes.
+func loadAuditBaseline() {
+	versions, err := historyVersions()
+	if err != nil {
+		log.Printf("Can't load audit baseline: %s", err.Error())
+		return
+	}
+	for _, version := range versions {
+		info, err := loadVersionInfo(version)
+		if err != nil || info.Metadata == nil {
+			continue
+		}
+		setAuditBaseline(info.Metadata)
+		log.Printf("Audit baseline loaded from version %d", version)
+		return
+	}
+}
+
+// Endpoint /audit
+// Return audit records filtered by time range and project.
+// Request example: http://controller-host:8081/audit?from=1600000000&to=1700000000&project=c9b8b104
+func auditQueryHandler(w http.ResponseWriter, r *http.Request) {
+	from, _ := strconv.ParseInt(r.URL.Query().Get("from"), 10, 64)
+	to, err := strconv.ParseInt(r.URL.Query().Get("to"), 10, 64)
+	if err != nil {
+		to = time.Now().Unix()
+	}
+	project := r.URL.Query().Get("project")
+
+	auditLock.Lock()
+	file, err := os.Open(auditFileName())
+	if err != nil {
+		auditLock.Unlock()
+		if os.IsNotExist(err) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte("[]\n"))
+			return
+		}
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	records := []auditRecord{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var record auditRecord
+		if json.Unmarshal(scanner.Bytes(), &record) != nil {
+			continue
+		}
+		if record.Time < from || record.Time > to {
+			continue
+		}
+		if project != "" && !containsString(record.ChangedProjects, project) {
+			continue
+		}
+		records = append(records, record)
+	}
+	file.Close()
+	auditLock.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(records)
+}
+
+// Return true if list contains item.
+func containsString(list []string, item string) bool {
+	for _, val := range list {
+		if val == item {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Set conf.pkg.dir to temp dir for test.
+func testPkgsDir(t *testing.T) string {
+	dir := t.TempDir()
+	old := *configsPkgsDir
+	*configsPkgsDir = dir
+	t.Cleanup(func() { *configsPkgsDir = old })
+	return dir
+}
+
+func TestChangedProjects(t *testing.T) {
+	base := func() projectsMetadataType {
+		return projectsMetadataType{
+			"p1": {Version: "1", Domains: map[string]*projectDomainData{"a.com": {SslType: 1}}},
+			"p2": {Version: "1", Domains: map[string]*projectDomainData{"b.com": {}}},
+		}
+	}
+	tests := []struct {
+		name     string
+		change   func(projectsMetadataType)
+		projects []string
+		domains  []string
+	}{
+		{"no changes", func(p projectsMetadataType) {}, []string{}, []string{}},
+		{"project var", func(p projectsMetadataType) { p["p1"].Version = "2" }, []string{"p1"}, []string{}},
+		{"domain ssl", func(p projectsMetadataType) { p["p1"].Domains["a.com"].SslType = 2 }, []string{"p1"}, []string{"p1/a.com"}},
+		{"domain added", func(p projectsMetadataType) { p["p2"].Domains["c.com"] = &projectDomainData{} }, []string{"p2"}, []string{"p2/c.com"}},
+		{"project removed", func(p projectsMetadataType) { delete(p, "p2") }, []string{"p2"}, []string{"p2/b.com"}},
+		{"project added", func(p projectsMetadataType) { p["p3"] = &projectMetadata{} }, []string{"p3"}, []string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			changed := base()
+			test.change(changed)
+			projects, domains := changedProjects(base(), changed)
+			if !reflect.DeepEqual(projects, test.projects) || !reflect.DeepEqual(domains, test.domains) {
+				t.Fatalf("got %v %v, want %v %v", projects, domains, test.projects, test.domains)
+			}
+		})
+	}
+}
+
+func TestLoadAuditBaseline(t *testing.T) {
+	testPkgsDir(t)
+	defer setAuditBaseline(nil)
+	old := projectsMetadataType{"p1": {Version: "1"}, "p2": {Version: "1"}}
+	latest := projectsMetadataType{"p1": {Version: "2"}, "p2": {Version: "1"}}
+	for version, metadata := range map[int]projectsMetadataType{3: old, 4: latest} {
+		if err := saveVersionInfo(versionInfo{Version: version, Source: versionSourceUpdate, Metadata: metadata}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setAuditBaseline(nil)
+	loadAuditBaseline()
+
+	// Only projects changed since latest version are reported after restart.
+	record := auditRecord{}
+	auditMetadata(&record, projectsMetadataType{"p1": {Version: "2"}, "p2": {Version: "3"}})
+	if !reflect.DeepEqual(record.ChangedProjects, []string{"p2"}) {
+		t.Fatalf("changed projects: %v", record.ChangedProjects)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// API roles. Operator is allowed everything, viewer - status endpoints, node - nodes endpoints.
+const (
+	roleNode     = "node"
+	roleViewer   = "viewer"
+	roleOperator = "operator"
+)
+
+// API client. Client is identified by token or by mTLS client certificate CN/SAN.
+type authClient struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+	Cn    string `json:"cn"`
+	Role  string `json:"role"`
+}
+
+// Tokens file (or consul key) format.
+// Example: {"clients": [{"name": "ops", "token": "secret", "role": "operator"}, {"name": "lb1", "cn": "lb1.example.com", "role": "node"}]}
+type authConfig struct {
+	Clients []authClient `json:"clients"`
+}
+
+var authFile = flag.String("auth.file",
+	getEnv("AUTH_FILE", ""),
+	"JSON file with API clients. Empty file and consul key - auth disabled.")
+
+var authConsulKey = flag.String("auth.consul.key",
+	getEnv("AUTH_CONSUL_KEY", ""),
+	"Consul key with API clients JSON (used if auth.file is empty).")
+
+var authReloadInterval = flag.Int64("auth.reload.interval",
+	getEnvInt64("AUTH_RELOAD_INTERVAL", 30),
+	"Seconds between API clients reload checks.")
+
+var authClients []authClient
+var authRaw []byte
+var authLock sync.RWMutex
+
+// Context key of authenticated client name and role.
+type authContextKey struct{}
+
+// Return true if API auth is configured.
+func authEnabled() bool {
+	return *authFile != "" || *authConsulKey != ""
+}
+
+// Load API clients from file or consul. Clients are replaced only if source content changed.
+func loadAuthClients() error {
+	var data []byte
+	var err error
+	if *authFile != "" {
+		data, err = ioutil.ReadFile(*authFile)
+	} else {
+		data, err = getConsulKvRaw(*authConsulKey)
+	}
+	if err != nil {
+		log.Printf("Can't read API clients: %s", err.Error())
+		return err
+	}
+	authLock.RLock()
+	changed := !bytes.Equal(data, authRaw)
+	authLock.RUnlock()
+	if !changed {
+		return nil
+	}
+	var conf authConfig
+	err = json.Unmarshal(data, &conf)
+	if err != nil {
+		log.Printf("Can't parse API clients: %s", err.Error())
+		return err
+	}
+	authLock.Lock()
+	authClients = conf.Clients
+	authRaw = data
+	authLock.Unlock()
+	log.Printf("API clients loaded: %d", len(conf.Clients))
+	return nil
+}
+
+// Reload API clients periodically, so tokens can be changed without restart.
+func authReloadLoop() {
+	for {
+		time.Sleep(time.Duration(*authReloadInterval) * time.Second)
+		loadAuthClients()
+	}
+}
+
+// Endpoints accepting token in 'token' query param: browser EventSource and WebSocket can't set headers.
+// Other endpoints accept Authorization header only, so tokens don't get to access logs.
+var queryTokenPaths = map[string]bool{"/events": true, "/events/ws": true}
+
+// Find client by request token or client certificate.
+func authenticate(r *http.Request) (authClient, bool) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" && queryTokenPaths[r.URL.Path] {
+		token = r.URL.Query().Get("token")
+	}
+	var names []string
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		cert := r.TLS.PeerCertificates[0]
+		names = append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	}
+	authLock.RLock()
+	defer authLock.RUnlock()
+	for _, client := range authClients {
+		if client.Token != "" && subtle.ConstantTimeCompare([]byte(client.Token), []byte(token)) == 1 {
+			return client, true
+		}
+		if client.Cn == "" {
+			continue
+		}
+		for _, name := range names {
+			if client.Cn == name {
+				return client, true
+			}
+		}
+	}
+	return authClient{}, false
+}
+
+// Return true if role has access to endpoints of required role.
+func roleAllowed(role, required string) bool {
+	return role == roleOperator || role == required
+}
+
+// Wrap handler with authentication and role check. Denied requests are logged.
+func requireRole(required string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authEnabled() {
+			handler(w, r)
+			return
+		}
+		sourceIP, _, _ := net.SplitHostPort(r.RemoteAddr)
+		client, ok := authenticate(r)
+		if !ok {
+			log.Printf("Access denied: %s %s from %s, unknown client.", r.Method, r.URL.Path, sourceIP)
+			http.Error(w, "Unauthorized.", 401)
+			return
+		}
+		if !roleAllowed(client.Role, required) {
+			log.Printf("Access denied: %s %s from %s, client: %s, role: %s, required: %s.", r.Method, r.URL.Path, sourceIP, client.Name, client.Role, required)
+			http.Error(w, "Forbidden.", 403)
+			return
+		}
+		handler(w, r.WithContext(context.WithValue(r.Context(), authContextKey{}, authClient{Name: client.Name, Role: client.Role})))
+	}
+}
+
+// Name of authenticated client, 'anonymous' if auth is disabled.
+func requestIdentity(r *http.Request) string {
+	if client, ok := r.Context().Value(authContextKey{}).(authClient); ok {
+		return client.Name
+	}
+	return "anonymous"
+}
+
+// Role of authenticated client, operator if auth is disabled.
+func requestRole(r *http.Request) string {
+	if client, ok := r.Context().Value(authContextKey{}).(authClient); ok {
+		return client.Role
+	}
+	return roleOperator
+}
+
+// Load API clients on start and run reload loop. Broken clients source is fatal, to not run open API by mistake.
+func initAuth() {
+	if !authEnabled() {
+		log.Println("API auth is disabled.")
+		return
+	}
+	if err := loadAuthClients(); err != nil {
+		log.Fatalln(err.Error())
+	}
+	go authReloadLoop()
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+const testAuthConfig = `{"clients": [
+	{"name": "ops", "token": "ops-token", "role": "operator"},
+	{"name": "dashboard", "token": "viewer-token", "role": "viewer"},
+	{"name": "lb1", "cn": "lb1.example.com", "role": "node"},
+	{"name": "lb2", "token": "node-token", "role": "node"}
+]}`
+
+// Enable auth with clients file content, auth state is restored after test.
+func testAuthClients(t *testing.T, config string) string {
+	name := filepath.Join(t.TempDir(), "clients.json")
+	if err := ioutil.WriteFile(name, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	oldFile, oldConsulKey := *authFile, *authConsulKey
+	authLock.Lock()
+	oldClients, oldRaw := authClients, authRaw
+	authClients, authRaw = nil, nil
+	authLock.Unlock()
+	*authFile, *authConsulKey = name, ""
+	t.Cleanup(func() {
+		*authFile, *authConsulKey = oldFile, oldConsulKey
+		authLock.Lock()
+		authClients, authRaw = oldClients, oldRaw
+		authLock.Unlock()
+	})
+	if err := loadAuthClients(); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+// Request with client certificate names.
+func testCertRequest(target, cn string, dnsNames ...string) *http.Request {
+	r := httptest.NewRequest("GET", target, nil)
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: cn}, DNSNames: dnsNames}}}
+	return r
+}
+
+func TestAuthenticate(t *testing.T) {
+	testAuthClients(t, testAuthConfig)
+	bearer := func(target, token string) *http.Request {
+		r := httptest.NewRequest("GET", target, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		return r
+	}
+	tests := []struct {
+		name   string
+		r      *http.Request
+		client string
+	}{
+		{"bearer token", bearer("/status", "ops-token"), "ops"},
+		{"bearer token of viewer", bearer("/versions", "viewer-token"), "dashboard"},
+		{"wrong token", bearer("/status", "ops-token2"), ""},
+		{"token prefix", bearer("/status", "ops"), ""},
+		{"empty bearer", bearer("/status", ""), ""},
+		{"no credentials", httptest.NewRequest("GET", "/status", nil), ""},
+		{"query token on events", httptest.NewRequest("GET", "/events?token=viewer-token", nil), "dashboard"},
+		{"query token on websocket events", httptest.NewRequest("GET", "/events/ws?token=viewer-token", nil), "dashboard"},
+		{"query token on other endpoint", httptest.NewRequest("GET", "/status?token=ops-token", nil), ""},
+		{"query token on getconf", httptest.NewRequest("GET", "/getconf?ver=1&token=node-token", nil), ""},
+		{"header has priority over query", bearer("/events?token=ops-token", "viewer-token"), "dashboard"},
+		{"certificate CN", testCertRequest("/getconf", "lb1.example.com"), "lb1"},
+		{"certificate SAN", testCertRequest("/getconf", "lb1", "lb1.internal", "lb1.example.com"), "lb1"},
+		{"unknown certificate", testCertRequest("/getconf", "lb3.example.com", "lb3.internal"), ""},
+		{"empty certificate names", testCertRequest("/getconf", ""), ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, ok := authenticate(test.r)
+			if ok != (test.client != "") || client.Name != test.client {
+				t.Fatalf("client %q, %v, want %q", client.Name, ok, test.client)
+			}
+		})
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	testAuthClients(t, testAuthConfig)
+	tokens := map[string]string{roleOperator: "ops-token", roleViewer: "viewer-token", roleNode: "node-token"}
+	tests := []struct {
+		required string
+		role     string
+		status   int
+	}{
+		{roleOperator, roleOperator, 200},
+		{roleOperator, roleViewer, 403},
+		{roleOperator, roleNode, 403},
+		{roleViewer, roleOperator, 200},
+		{roleViewer, roleViewer, 200},
+		{roleViewer, roleNode, 403},
+		{roleNode, roleOperator, 200},
+		{roleNode, roleViewer, 403},
+		{roleNode, roleNode, 200},
+		{roleViewer, "", 401},
+	}
+	for _, test := range tests {
+		var identity, role string
+		handler := requireRole(test.required, func(w http.ResponseWriter, r *http.Request) {
+			identity, role = requestIdentity(r), requestRole(r)
+		})
+		r := httptest.NewRequest("GET", "/status", nil)
+		if test.role != "" {
+			r.Header.Set("Authorization", "Bearer "+tokens[test.role])
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != test.status {
+			t.Fatalf("%s for %s endpoint: status %d, want %d", test.role, test.required, w.Code, test.status)
+		}
+		if test.status == 200 && role != test.role {
+			t.Fatalf("%s for %s endpoint: handler got role %s, identity %s", test.role, test.required, role, identity)
+		}
+		if test.status != 200 && role != "" {
+			t.Fatalf("%s for %s endpoint: handler is called", test.role, test.required)
+		}
+	}
+}
+
+func TestRequireRoleAuthDisabled(t *testing.T) {
+	testAuthClients(t, testAuthConfig)
+	*authFile = ""
+	var identity, role string
+	w := httptest.NewRecorder()
+	requireRole(roleOperator, func(w http.ResponseWriter, r *http.Request) {
+		identity, role = requestIdentity(r), requestRole(r)
+	})(w, httptest.NewRequest("POST", "/rollback?to=1", nil))
+	if w.Code != 200 || identity != "anonymous" || role != roleOperator {
+		t.Fatalf("status %d, identity %s, role %s", w.Code, identity, role)
+	}
+}
+
+func TestLoadAuthClientsBroken(t *testing.T) {
+	name := testAuthClients(t, testAuthConfig)
+	check := func(token, client string) {
+		r := httptest.NewRequest("GET", "/status", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		found, ok := authenticate(r)
+		if ok != (client != "") || found.Name != client {
+			t.Fatalf("token %s: client %q, want %q", token, found.Name, client)
+		}
+	}
+	// Broken file: old clients are kept.
+	if err := ioutil.WriteFile(name, []byte(`{"clients": [`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadAuthClients(); err == nil {
+		t.Fatal("broken clients file is loaded")
+	}
+	check("ops-token", "ops")
+	// Missing file: old clients are kept.
+	*authFile = name + ".missing"
+	if err := loadAuthClients(); err == nil {
+		t.Fatal("missing clients file is loaded")
+	}
+	check("ops-token", "ops")
+	// Fixed file replaces clients, removed token is not accepted.
+	*authFile = name
+	if err := ioutil.WriteFile(name, []byte(`{"clients": [{"name": "ops2", "token": "new-token", "role": "operator"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadAuthClients(); err != nil {
+		t.Fatal(err)
+	}
+	check("new-token", "ops2")
+	check("ops-token", "")
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -25,6 +26,7 @@ func getConsulConfVersion() (Version int, Error error) {
 
 	// Check error.
 	if err != nil {
+		consulErrorsTotal.Inc()
 		log.Printf("Error get config version from consul: %s, check url: %s", err.Error(), verGetUrl)
 		return 0, err
 	}
@@ -34,12 +36,14 @@ func getConsulConfVersion() (Version int, Error error) {
 	// Read version from http respond
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
+		consulErrorsTotal.Inc()
 		log.Printf("Error get config version from consul: %s, check url: %s", err.Error(), verGetUrl)
 		return 0, err
 	}
 	// Convert version to int.
 	version, err := strconv.Atoi(string(body))
 	if err != nil {
+		consulErrorsTotal.Inc()
 		log.Printf("Error get config version from consul: %s, check url: %s", err.Error(), verGetUrl)
 		return 0, err
 	}
@@ -49,6 +53,8 @@ func getConsulConfVersion() (Version int, Error error) {
 
 // http GET - get recurse JSON data of 'keyname'.
 func getConsulKvJson(keyname string) (data []byte, Error error) {
+	start := time.Now()
+	defer observeStage(stageConsulFetch, start)
 	// Consul url to get current config version.
 	consulGetUrl := "http://" + *consulUrl + "/v1/kv/" + keyname + "?recurse"
 	// Send request to consul API.
@@ -56,6 +62,7 @@ func getConsulKvJson(keyname string) (data []byte, Error error) {
 
 	// Check error.
 	if err != nil {
+		consulErrorsTotal.Inc()
 		log.Printf("Error get data from consul: %s, check url: %s", err.Error(), consulGetUrl)
 		return nil, err
 	}
@@ -65,22 +72,46 @@ func getConsulKvJson(keyname string) (data []byte, Error error) {
 	// Read data from http respond
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
+		consulErrorsTotal.Inc()
 		log.Printf("Error get data from consul: %s, check url: %s", err.Error(), consulGetUrl)
 		return nil, err
 	}
+	log.Printf("Receiving data from consul time: %s", time.Since(start))
 	// Return config version.
 	return body, nil
 }
 
-// Increment configs version value in consul, using consul REST API.
-func incrConsulConfVersion() (Version int, Error error) {
+// http GET - get raw value of 'keyname'.
+func getConsulKvRaw(keyname string) (data []byte, Error error) {
+	consulGetUrl := "http://" + *consulUrl + "/v1/kv/" + keyname + "?raw"
+	// Send request to consul API.
+	resp, err := http.Get(consulGetUrl)
+	if err != nil {
+		consulErrorsTotal.Inc()
+		log.Printf("Error get data from consul: %s, check url: %s", err.Error(), consulGetUrl)
+		return nil, err
+	}
+	// Close body after return (see defer)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		consulErrorsTotal.Inc()
+		return nil, fmt.Errorf("Error get data from consul, status: %s, check url: %s", resp.Status, consulGetUrl)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Next configs version number. Version is published by setConsulConfVersion after packages are ready.
+func nextConsulConfVersion() (Version int, Error error) {
 	// get curent version
 	version, err := getConsulConfVersion()
 	if err != nil {
 		return 0, err
 	}
-	// increment version
-	version = version + 1
+	return version + 1, nil
+}
+
+// Set configs version value in consul, using consul REST API.
+func setConsulConfVersion(version int) error {
 	// POST request to put updated version to consul kv.
 	verPutUrl := "http://" + *consulUrl + "/v1/kv/" + *configVersionKey
 	// Init http cli
@@ -89,31 +120,35 @@ func incrConsulConfVersion() (Version int, Error error) {
 	req, err := http.NewRequest(http.MethodPut, verPutUrl, strings.NewReader(strconv.Itoa(version)))
 	if err != nil {
 		log.Println(err.Error())
-		return 0, err
+		return err
 	}
 	// Sent post request.
-	_, err = client.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
+		consulErrorsTotal.Inc()
 		log.Println(err.Error())
-		return 0, err
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		consulErrorsTotal.Inc()
+		return fmt.Errorf("Can't set config version in consul, status: %s", resp.Status)
 	}
 	time.Sleep(1 * time.Second)
 	log.Printf("Config version increased. New version: %d\n", version)
-	return version, nil
+	return nil
 }
 
+// Parse recurse JSON data of consul 'clients' key to projects metadata.
 func parseConsulProjectsData(consulData []byte) projectsMetadataType {
-	start := time.Now()
-	consulData, err := getConsulKvJson("clients")
-	elapsed := time.Since(start)
-	if err != nil {
+	if consulData == nil {
 		return nil
 	}
-	log.Printf("Receiving data from consul time: %s", elapsed)
-	start = time.Now()
+	start := time.Now()
+	defer observeStage(stageParse, start)
 	var parsedData = consulCliData{}
-	err = json.Unmarshal(consulData, &parsedData)
-	elapsed = time.Since(start)
+	err := json.Unmarshal(consulData, &parsedData)
+	elapsed := time.Since(start)
 	if err != nil {
 		log.Printf("Can't parse data: %s", err.Error())
 		return nil
@@ -193,12 +228,21 @@ func parseConsulProjectsData(consulData []byte) projectsMetadataType {
 
 		case "storage":
 			projects[clientUuid].Storage = val
+		case "groups":
+			// Comma separated list of node groups, example: 'public,regional'.
+			projects[clientUuid].Groups = nil
+			for _, group := range strings.Split(val, ",") {
+				if group = strings.TrimSpace(group); group != "" {
+					projects[clientUuid].Groups = append(projects[clientUuid].Groups, group)
+				}
+			}
 
 		}
 
 	}
 	elapsed = time.Since(start)
 	log.Printf("Parsing data to struct: %s", elapsed)
+	setMetadataMetrics(projects)
 
 	return projects
 }
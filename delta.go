@@ -0,0 +1,125 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Delta package entry with list of deleted files, one path per line.
+const deltaDeletedName = ".delta-deleted"
+
+// Response header of delta package with base version.
+const deltaFromHeader = "X-Delta-From"
+
+// Only one delta package is built at a time.
+var deltaLock sync.Mutex
+
+// Delta package file name, next to full packages of group.
+func deltaPackageFile(group string, from, to int) string {
+	return fmt.Sprintf("%s/%d_%d.delta.tar.gz", groupDir(*configsPkgsDir, group), to, from)
+}
+
+// Get delta package of group from version 'from' to version 'to', build it if not cached.
+func deltaPackage(group string, from, to int) (string, error) {
+	if from <= 0 || from >= to {
+		return "", fmt.Errorf("Bad delta base version %d for version %d", from, to)
+	}
+	deltaName := deltaPackageFile(group, from, to)
+	deltaLock.Lock()
+	defer deltaLock.Unlock()
+	if err := ensureLocal(deltaName); err == nil {
+		// Delta could be cached before signing was enabled.
+		if _, err = readSignature(deltaName); err == nil || !signingEnabled() {
+			return deltaName, nil
+		}
+		if err = signFile(deltaName); err != nil {
+			return "", err
+		}
+		return deltaName, storeFiles(signatureFile(deltaName))
+	}
+	oldFiles, err := readPackage(fmt.Sprintf("%s/%d.tar.gz", groupDir(*configsPkgsDir, group), from))
+	if err != nil {
+		return "", err
+	}
+	newFiles, err := readPackage(fmt.Sprintf("%s/%d.tar.gz", groupDir(*configsPkgsDir, group), to))
+	if err != nil {
+		return "", err
+	}
+	err = writeDeltaPackage(deltaName, oldFiles, newFiles)
+	if err == nil {
+		err = signFile(deltaName)
+	}
+	if err != nil {
+		return "", err
+	}
+	return deltaName, storeFiles(deltaName, signatureFile(deltaName))
+}
+
+// Write tar.gz with added and changed files and list of deleted files.
+func writeDeltaPackage(deltaName string, oldFiles, newFiles map[string]packageFile) (Error error) {
+	var changed, deleted []string
+	for name, file := range newFiles {
+		if oldFile, ok := oldFiles[name]; !ok || oldFile != file {
+			changed = append(changed, name)
+		}
+	}
+	for name := range oldFiles {
+		if _, ok := newFiles[name]; !ok {
+			deleted = append(deleted, name)
+		}
+	}
+	sort.Strings(changed)
+	sort.Strings(deleted)
+
+	tmpName := deltaName + ".tmp"
+	out, err := os.Create(tmpName)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		out.Close()
+		if Error != nil {
+			os.Remove(tmpName)
+		}
+	}()
+	zw := gzip.NewWriter(out)
+	tw := tar.NewWriter(zw)
+	writeEntry := func(name string, mode int64, data string) error {
+		header := &tar.Header{Name: name, Mode: mode, Size: int64(len(data)), ModTime: tarEntryTime, Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err := tw.Write([]byte(data))
+		return err
+	}
+	for _, name := range changed {
+		if err = writeEntry(name, newFiles[name].mode, newFiles[name].data); err != nil {
+			return err
+		}
+	}
+	deletedList := ""
+	if len(deleted) > 0 {
+		deletedList = strings.Join(deleted, "\n") + "\n"
+	}
+	if err = writeEntry(deltaDeletedName, 0644, deletedList); err != nil {
+		return err
+	}
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	if err = zw.Close(); err != nil {
+		return err
+	}
+	if err = out.Sync(); err != nil {
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, deltaName)
+}
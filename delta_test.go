@@ -0,0 +1,249 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Package files from files data, mode 0644.
+func testPackageFiles(files map[string]string) map[string]packageFile {
+	result := make(map[string]packageFile)
+	for name, data := range files {
+		result[name] = packageFile{mode: 0644, data: data}
+	}
+	return result
+}
+
+// Make package of version in conf.pkg.dir the way controller does.
+func testPublishVersion(t *testing.T, version int, files map[string]string) {
+	src := t.TempDir()
+	writeTestFiles(t, src, files)
+	manifest, err := buildManifest(version, *defaultGroup, src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestData, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = compress(src, fmt.Sprintf("%s/%d", groupDir(*configsPkgsDir, *defaultGroup), version), manifestData)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtractDelta(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new map[string]string
+	}{
+		{"no changes", map[string]string{"a.conf": "a"}, map[string]string{"a.conf": "a"}},
+		{"added", map[string]string{"a.conf": "a"}, map[string]string{"a.conf": "a", "sites/b.conf": "b"}},
+		{"changed", map[string]string{"a.conf": "a", "b.conf": "b"}, map[string]string{"a.conf": "a2", "b.conf": "b"}},
+		{"deleted", map[string]string{"a.conf": "a", "sites/b.conf": "b"}, map[string]string{"a.conf": "a"}},
+		{"replaced all", map[string]string{"a.conf": "a", "b.conf": "b"}, map[string]string{"c.conf": "c"}},
+		{"from empty", map[string]string{}, map[string]string{"a.conf": "a"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			deltaName := filepath.Join(t.TempDir(), "2_1.delta.tar.gz")
+			if err := writeDeltaPackage(deltaName, testPackageFiles(test.old), testPackageFiles(test.new)); err != nil {
+				t.Fatal(err)
+			}
+			current, staging := t.TempDir(), filepath.Join(t.TempDir(), "staging")
+			writeTestFiles(t, current, test.old)
+			delta, err := os.Open(deltaName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer delta.Close()
+			if err = extractDelta(delta, current, staging); err != nil {
+				t.Fatal(err)
+			}
+			if got := readTestFiles(t, staging); !reflect.DeepEqual(got, test.new) {
+				t.Fatalf("got %v, want %v", got, test.new)
+			}
+			// Current configs are not changed.
+			if got := readTestFiles(t, current); !reflect.DeepEqual(got, test.old) {
+				t.Fatalf("current configs changed: %v", got)
+			}
+		})
+	}
+}
+
+func TestExtractDeltaBad(t *testing.T) {
+	tarGz := func(files map[string]string) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(zw)
+		for name, data := range files {
+			tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg})
+			tw.Write([]byte(data))
+		}
+		tw.Close()
+		zw.Close()
+		return buf.Bytes()
+	}
+	tests := []struct {
+		name  string
+		files map[string]string
+		error string
+	}{
+		{"no deleted list", map[string]string{"a.conf": "a"}, "bad delta package"},
+		{"deleted out of dir", map[string]string{deltaDeletedName: "../a.conf\n"}, "bad path"},
+		{"deleted absolute path", map[string]string{deltaDeletedName: "/etc/passwd\n"}, "bad path"},
+		{"entry out of dir", map[string]string{"../a.conf": "a", deltaDeletedName: ""}, "bad path"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			current := t.TempDir()
+			writeTestFiles(t, current, map[string]string{"a.conf": "a"})
+			err := extractDelta(bytes.NewReader(tarGz(test.files)), current, filepath.Join(t.TempDir(), "staging"))
+			if err == nil || !strings.Contains(err.Error(), test.error) {
+				t.Fatalf("error %v, want %q", err, test.error)
+			}
+			if got := readTestFiles(t, current); !reflect.DeepEqual(got, map[string]string{"a.conf": "a"}) {
+				t.Fatalf("current configs changed: %v", got)
+			}
+		})
+	}
+}
+
+func TestDeltaPackageRoundTrip(t *testing.T) {
+	testPkgsDir(t)
+	oldFiles := map[string]string{"a.conf": "a", "b.conf": "b", "sites/c.conf": "c"}
+	newFiles := map[string]string{"a.conf": "a2", "sites/c.conf": "c", "sites/d.conf": "d"}
+	testPublishVersion(t, 1, oldFiles)
+	testPublishVersion(t, 2, newFiles)
+	deltaName, err := deltaPackage(*defaultGroup, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Cached delta is returned on next request.
+	if cached, err := deltaPackage(*defaultGroup, 1, 2); err != nil || cached != deltaName {
+		t.Fatalf("cached delta: %s, %v", cached, err)
+	}
+	current, staging := t.TempDir(), filepath.Join(t.TempDir(), "staging")
+	writeTestFiles(t, current, oldFiles)
+	delta, err := os.Open(deltaName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer delta.Close()
+	if err = extractDelta(delta, current, staging); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = verifyStagingManifest(agentConfig{}, 2, staging); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFiles(t, staging); !reflect.DeepEqual(got, newFiles) {
+		t.Fatalf("got %v, want %v", got, newFiles)
+	}
+	if _, err := deltaPackage(*defaultGroup, 2, 2); err == nil {
+		t.Fatal("delta to the same version is built")
+	}
+}
+
+func TestSendConfDeltaGroup(t *testing.T) {
+	testPkgsDir(t)
+	testPublishVersion(t, 1, map[string]string{"a.conf": "a"})
+	testPublishVersion(t, 2, map[string]string{"a.conf": "a2"})
+	rolloutLock.Lock()
+	oldRollout := rollout
+	rollout = &rolloutState{Version: 2, Status: rolloutDone}
+	rolloutLock.Unlock()
+	t.Cleanup(func() {
+		rolloutLock.Lock()
+		rollout = oldRollout
+		rolloutLock.Unlock()
+		serversLock.Lock()
+		delete(serversState, "192.0.2.1")
+		serversLock.Unlock()
+	})
+	tests := []struct {
+		name  string
+		query string
+		delta bool
+	}{
+		{"same group", "&from=1&from_group=" + *defaultGroup, true},
+		{"other group", "&from=1&from_group=internal", false},
+		{"unknown group", "&from=1", false},
+		{"no base", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/getconf?ver=2"+test.query, nil)
+			r.RemoteAddr = "192.0.2.1:1234"
+			w := httptest.NewRecorder()
+			sendConfHandler(w, r)
+			if w.Code != 200 {
+				t.Fatalf("status %d: %s", w.Code, w.Body.String())
+			}
+			if delta := w.Header().Get(deltaFromHeader) == "1"; delta != test.delta {
+				t.Fatalf("delta sent: %v, want %v", delta, test.delta)
+			}
+		})
+	}
+}
+
+func TestAgentApplyDeltaFallback(t *testing.T) {
+	oldFiles := map[string]string{"a.conf": "a", "b.conf": "b"}
+	newFiles := map[string]string{"a.conf": "a2", "b.conf": "b"}
+	testPkgsDir(t)
+	testPublishVersion(t, 1, oldFiles)
+	testPublishVersion(t, 2, newFiles)
+	deltaName, err := deltaPackage(*defaultGroup, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, err := ioutil.ReadFile(packageFileName(*defaultGroup, 2, formatGzip))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lock sync.Mutex
+	var queries []string
+	controller := newTestController(t, full)
+	controller.server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/getconf" {
+			return
+		}
+		lock.Lock()
+		queries = append(queries, r.URL.RawQuery)
+		lock.Unlock()
+		if r.URL.Query().Get("from") != "" {
+			w.Header().Set(deltaFromHeader, r.URL.Query().Get("from"))
+			http.ServeFile(w, r, deltaName)
+			return
+		}
+		w.Write(full)
+	})
+	conf := testAgentConfig(t, controller)
+	// Loaded version 1 is changed locally, delta gives files not matching manifest.
+	writeTestFiles(t, conf.ConfDir, map[string]string{"a.conf": "a", "b.conf": "local change"})
+	manifest, _ := json.Marshal(packageManifest{Version: 1, Group: *defaultGroup})
+	writeTestFiles(t, conf.StateDir, map[string]string{"version": "1", manifestName: string(manifest)})
+	setAgentVersion(1)
+
+	if err := agentApply(conf, 2, controller.server.URL+"/getconf?ver=2"); err != nil {
+		t.Fatalf("apply failed: %s", err)
+	}
+	if got := readTestFiles(t, conf.ConfDir); !reflect.DeepEqual(got, newFiles) {
+		t.Fatalf("configs %v, want %v", got, newFiles)
+	}
+	want := []string{"ver=2&format=zstd&from=1&from_group=" + *defaultGroup, "ver=2&format=zstd"}
+	if !reflect.DeepEqual(queries, want) {
+		t.Fatalf("requests %v, want %v", queries, want)
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Lines of context around changes in unified diff.
+const diffContext = 3
+
+// Max LCS table size, bigger files are shown as replaced completely.
+const diffMaxTable = 16 * 1024 * 1024
+
+// Domain setting change.
+type domainChange struct {
+	Domain string `json:"domain"`
+	Old    string `json:"old"`
+	New    string `json:"new"`
+}
+
+// Project variable change.
+type varChange struct {
+	Project string `json:"project"`
+	Name    string `json:"name"`
+	Old     string `json:"old"`
+	New     string `json:"new"`
+}
+
+// Semantic diff of projects metadata. Domains are in 'project/domain' format.
+type metadataDiff struct {
+	ProjectsAdded   []string       `json:"projects_added"`
+	ProjectsRemoved []string       `json:"projects_removed"`
+	DomainsAdded    []string       `json:"domains_added"`
+	DomainsRemoved  []string       `json:"domains_removed"`
+	SslChanged      []domainChange `json:"ssl_changed"`
+	RedirectChanged []domainChange `json:"redirect_changed"`
+	VarsChanged     []varChange    `json:"vars_changed"`
+}
+
+// /versions/{a}/diff/{b} response.
+type versionsDiff struct {
+	From     int          `json:"from"`
+	To       int          `json:"to"`
+	Metadata metadataDiff `json:"metadata"`
+	Files    string       `json:"files"`
+}
+
+// Find projects, domains and variables changes between metadata.
+func diffMetadata(oldProjects, newProjects projectsMetadataType) metadataDiff {
+	diff := metadataDiff{
+		ProjectsAdded:   []string{},
+		ProjectsRemoved: []string{},
+		DomainsAdded:    []string{},
+		DomainsRemoved:  []string{},
+		SslChanged:      []domainChange{},
+		RedirectChanged: []domainChange{},
+		VarsChanged:     []varChange{},
+	}
+	for _, uuid := range sortedKeys(unionKeys(oldProjects, newProjects)) {
+		oldProject, newProject := oldProjects[uuid], newProjects[uuid]
+		if oldProject == nil {
+			oldProject = &projectMetadata{}
+			diff.ProjectsAdded = append(diff.ProjectsAdded, uuid)
+		}
+		if newProject == nil {
+			newProject = &projectMetadata{}
+			diff.ProjectsRemoved = append(diff.ProjectsRemoved, uuid)
+		}
+		for _, domain := range sortedKeys(unionDomains(oldProject.Domains, newProject.Domains)) {
+			oldDomain, newDomain := oldProject.Domains[domain], newProject.Domains[domain]
+			name := uuid + "/" + domain
+			switch {
+			case oldDomain == nil:
+				diff.DomainsAdded = append(diff.DomainsAdded, name)
+			case newDomain == nil:
+				diff.DomainsRemoved = append(diff.DomainsRemoved, name)
+			default:
+				if oldDomain.SslType != newDomain.SslType {
+					diff.SslChanged = append(diff.SslChanged, domainChange{name, strconv.Itoa(oldDomain.SslType), strconv.Itoa(newDomain.SslType)})
+				}
+				if oldDomain.Redirect != newDomain.Redirect {
+					diff.RedirectChanged = append(diff.RedirectChanged, domainChange{name, strconv.FormatBool(oldDomain.Redirect), strconv.FormatBool(newDomain.Redirect)})
+				}
+			}
+		}
+		// Other project fields are variables.
+		oldValue, newValue := reflect.ValueOf(*oldProject), reflect.ValueOf(*newProject)
+		for i := 0; i < oldValue.NumField(); i++ {
+			field := oldValue.Type().Field(i).Name
+			if field == "Domains" {
+				continue
+			}
+			oldVar, newVar := fmt.Sprint(oldValue.Field(i).Interface()), fmt.Sprint(newValue.Field(i).Interface())
+			if oldVar != newVar {
+				diff.VarsChanged = append(diff.VarsChanged, varChange{uuid, field, oldVar, newVar})
+			}
+		}
+	}
+	return diff
+}
+
+// Sorted keys of set.
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Regular file of package.
+type packageFile struct {
+	mode int64
+	data string
+}
+
+// Read regular files content of tar.gz package.
+func readPackageFiles(pkgName string) (map[string]string, error) {
+	files, err := readPackage(pkgName)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]string)
+	for name, file := range files {
+		result[name] = file.data
+	}
+	return result, nil
+}
+
+// Read regular files of tar.gz package.
+func readPackage(pkgName string) (map[string]packageFile, error) {
+	err := ensureLocal(pkgName)
+	if err != nil {
+		return nil, err
+	}
+	pkg, err := os.Open(pkgName)
+	if err != nil {
+		return nil, err
+	}
+	defer pkg.Close()
+	zr, err := decompress(pkg)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	files := make(map[string]packageFile)
+	tr := tar.NewReader(zr)
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			if err == io.EOF {
+				return files, nil
+			}
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		files[header.Name] = packageFile{header.Mode, string(data)}
+	}
+}
+
+// Unified diff of files in packages of two versions, for all node groups.
+func diffPackages(from, to int) (string, error) {
+	var result strings.Builder
+	for _, group := range nodeGroupNames() {
+		groupPkgsDir := groupDir(*configsPkgsDir, group)
+		oldFiles, err := readPackageFiles(fmt.Sprintf("%s/%d.tar.gz", groupPkgsDir, from))
+		if err != nil {
+			return "", err
+		}
+		newFiles, err := readPackageFiles(fmt.Sprintf("%s/%d.tar.gz", groupPkgsDir, to))
+		if err != nil {
+			return "", err
+		}
+		names := make(map[string]bool)
+		for name := range oldFiles {
+			names[name] = true
+		}
+		for name := range newFiles {
+			names[name] = true
+		}
+		delete(names, manifestName)
+		for _, name := range sortedKeys(names) {
+			path := name
+			if groupsEnabled() {
+				path = group + "/" + name
+			}
+			oldName, newName := "a/"+path, "b/"+path
+			if _, ok := oldFiles[name]; !ok {
+				oldName = "/dev/null"
+			}
+			if _, ok := newFiles[name]; !ok {
+				newName = "/dev/null"
+			}
+			result.WriteString(unifiedDiff(oldName, newName, oldFiles[name], newFiles[name]))
+		}
+	}
+	return result.String(), nil
+}
+
+// Diff operation: ' ' - same line, '-' - removed, '+' - added.
+type diffLine struct {
+	op   byte
+	text string
+}
+
+// Split text to lines without trailing empty line.
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// Line operations to get b from a (longest common subsequence).
+func diffLines(a, b []string) []diffLine {
+	var lines []diffLine
+	// Common prefix and suffix don't need LCS table.
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		lines = append(lines, diffLine{' ', a[prefix]})
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	midA, midB := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	n, m := len(midA), len(midB)
+	if n*m > diffMaxTable {
+		for _, line := range midA {
+			lines = append(lines, diffLine{'-', line})
+		}
+		for _, line := range midB {
+			lines = append(lines, diffLine{'+', line})
+		}
+	} else {
+		// lcs[i*(m+1)+j] - LCS length of midA[i:] and midB[j:].
+		lcs := make([]int32, (n+1)*(m+1))
+		for i := n - 1; i >= 0; i-- {
+			for j := m - 1; j >= 0; j-- {
+				if midA[i] == midB[j] {
+					lcs[i*(m+1)+j] = lcs[(i+1)*(m+1)+j+1] + 1
+				} else if lcs[(i+1)*(m+1)+j] >= lcs[i*(m+1)+j+1] {
+					lcs[i*(m+1)+j] = lcs[(i+1)*(m+1)+j]
+				} else {
+					lcs[i*(m+1)+j] = lcs[i*(m+1)+j+1]
+				}
+			}
+		}
+		i, j := 0, 0
+		for i < n || j < m {
+			switch {
+			case i < n && j < m && midA[i] == midB[j]:
+				lines = append(lines, diffLine{' ', midA[i]})
+				i++
+				j++
+			case j == m || (i < n && lcs[(i+1)*(m+1)+j] >= lcs[i*(m+1)+j+1]):
+				lines = append(lines, diffLine{'-', midA[i]})
+				i++
+			default:
+				lines = append(lines, diffLine{'+', midB[j]})
+				j++
+			}
+		}
+	}
+	for _, line := range a[len(a)-suffix:] {
+		lines = append(lines, diffLine{' ', line})
+	}
+	return lines
+}
+
+// Unified diff of two texts, empty if texts are equal.
+func unifiedDiff(oldName, newName, oldText, newText string) string {
+	if oldText == newText {
+		return ""
+	}
+	lines := diffLines(splitLines(oldText), splitLines(newText))
+	// Line numbers in a and b before each operation.
+	posA, posB := make([]int, len(lines)+1), make([]int, len(lines)+1)
+	var changes []int
+	for i, line := range lines {
+		posA[i+1], posB[i+1] = posA[i], posB[i]
+		if line.op != '+' {
+			posA[i+1]++
+		}
+		if line.op != '-' {
+			posB[i+1]++
+		}
+		if line.op != ' ' {
+			changes = append(changes, i)
+		}
+	}
+	var result strings.Builder
+	fmt.Fprintf(&result, "--- %s\n+++ %s\n", oldName, newName)
+	for k := 0; k < len(changes); {
+		// Join changes with close context into one hunk.
+		last := k
+		for last+1 < len(changes) && changes[last+1]-changes[last] <= 2*diffContext {
+			last++
+		}
+		start, end := changes[k]-diffContext, changes[last]+diffContext+1
+		if start < 0 {
+			start = 0
+		}
+		if end > len(lines) {
+			end = len(lines)
+		}
+		fmt.Fprintf(&result, "@@ -%s +%s @@\n", hunkRange(posA[start], posA[end]-posA[start]), hunkRange(posB[start], posB[end]-posB[start]))
+		for _, line := range lines[start:end] {
+			result.WriteByte(line.op)
+			result.WriteString(line.text)
+			result.WriteByte('\n')
+		}
+		k = last + 1
+	}
+	return result.String()
+}
+
+// Hunk range in 'start,count' format, start is 1-based (line before hunk for empty range).
+// Count of one line range is omitted, as diff -u does.
+func hunkRange(pos, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", pos)
+	case 1:
+		return strconv.Itoa(pos + 1)
+	}
+	return fmt.Sprintf("%d,%d", pos+1, count)
+}
+
+// Endpoint /versions/{from}/diff/{to}
+// Return metadata changes and unified diff of rendered configs between versions.
+// Operator only: vars and rendered configs contain service urls with credentials.
+// Request example: http://controller-host:8081/versions/12340/diff/12345?format=text
+func versionsDiffHandler(w http.ResponseWriter, r *http.Request) {
+	from, errFrom := strconv.Atoi(mux.Vars(r)["from"])
+	to, errTo := strconv.Atoi(mux.Vars(r)["to"])
+	if errFrom != nil || errTo != nil {
+		http.Error(w, "Bad version number.", 400)
+		return
+	}
+	diff := versionsDiff{From: from, To: to}
+	fromInfo, err := loadVersionInfo(from)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Version %d not found.", from), 404)
+		return
+	}
+	toInfo, err := loadVersionInfo(to)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Version %d not found.", to), 404)
+		return
+	}
+	diff.Metadata = diffMetadata(fromInfo.Metadata, toInfo.Metadata)
+	diff.Files, err = diffPackages(from, to)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Can't read packages: %s", err.Error()), 404)
+		return
+	}
+	if r.URL.Query().Get("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(diff.Files))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(diff)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Operations of diff lines as string, like ' -+ '.
+func diffOps(lines []diffLine) string {
+	var ops strings.Builder
+	for _, line := range lines {
+		ops.WriteByte(line.op)
+	}
+	return ops.String()
+}
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		ops  string
+		same int
+	}{
+		{"equal", "a b c", "a b c", "   ", 3},
+		{"both empty", "", "", "", 0},
+		{"added to empty", "", "x y", "++", 0},
+		{"all removed", "x y", "", "--", 0},
+		{"changed middle", "a b c", "a x c", " -+ ", 2},
+		{"removed middle", "a b c", "a c", " - ", 2},
+		{"added middle", "a c", "a b c", " + ", 2},
+		{"shifted", "a b c d", "b c d e", "-   +", 3},
+		{"replaced all", "a b", "c d", "--++", 0},
+		{"crossed", "a b a b", "b a b a", "", 3},
+		{"repeated lines", "x a x b x", "x b x a x", "", 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, b := strings.Fields(test.a), strings.Fields(test.b)
+			lines := diffLines(a, b)
+			if test.ops != "" && diffOps(lines) != test.ops {
+				t.Fatalf("ops %q, want %q", diffOps(lines), test.ops)
+			}
+			// Old text is ' ' and '-' lines, new text is ' ' and '+' lines.
+			var gotA, gotB []string
+			same := 0
+			for _, line := range lines {
+				if line.op != '+' {
+					gotA = append(gotA, line.text)
+				}
+				if line.op != '-' {
+					gotB = append(gotB, line.text)
+				}
+				if line.op == ' ' {
+					same++
+				}
+			}
+			if strings.Join(gotA, " ") != test.a || strings.Join(gotB, " ") != test.b {
+				t.Fatalf("diff doesn't restore texts: %q, %q", gotA, gotB)
+			}
+			// Kept lines are the longest common subsequence.
+			if same != test.same {
+				t.Fatalf("kept lines %d, want %d", same, test.same)
+			}
+		})
+	}
+}
+
+func TestDiffLinesTooBig(t *testing.T) {
+	a, b := []string{"same"}, []string{"same"}
+	for i := 0; i < 5000; i++ {
+		a = append(a, fmt.Sprintf("a%d", i))
+		b = append(b, fmt.Sprintf("b%d", i))
+	}
+	// 5000*5000 table is over diffMaxTable, changed part is shown as replaced.
+	ops := diffOps(diffLines(a, b))
+	if ops != " "+strings.Repeat("-", 5000)+strings.Repeat("+", 5000) {
+		t.Fatalf("unexpected ops for big files: %.20q...", ops)
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	numbers := func(from, to int, replace map[int]string) string {
+		var text strings.Builder
+		for i := from; i <= to; i++ {
+			if line, ok := replace[i]; ok {
+				text.WriteString(line + "\n")
+			} else {
+				fmt.Fprintf(&text, "%d\n", i)
+			}
+		}
+		return text.String()
+	}
+	tests := []struct {
+		name     string
+		old, new string
+		want     string
+	}{
+		{"equal", "a\nb\n", "a\nb\n", ""},
+		{
+			"change with context",
+			numbers(1, 10, nil), numbers(1, 10, map[int]string{5: "five"}),
+			"@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+five\n 6\n 7\n 8\n",
+		},
+		{
+			"distant changes in separate hunks",
+			numbers(1, 20, nil), numbers(1, 20, map[int]string{2: "two", 19: "nineteen"}),
+			"@@ -1,5 +1,5 @@\n 1\n-2\n+two\n 3\n 4\n 5\n@@ -16,5 +16,5 @@\n 16\n 17\n 18\n-19\n+nineteen\n 20\n",
+		},
+		{
+			"close changes in one hunk",
+			numbers(1, 12, nil), numbers(1, 12, map[int]string{3: "three", 8: "eight"}),
+			"@@ -1,11 +1,11 @@\n 1\n 2\n-3\n+three\n 4\n 5\n 6\n 7\n-8\n+eight\n 9\n 10\n 11\n",
+		},
+		{"new file", "", "a\nb\n", "@@ -0,0 +1,2 @@\n+a\n+b\n"},
+		{"deleted file", "a\n", "", "@@ -1 +0,0 @@\n-a\n"},
+		{"one line", "1\n2\n3\n", "1\nx\n3\n", "@@ -1,3 +1,3 @@\n 1\n-2\n+x\n 3\n"},
+		{"removed line", "a\nb\nc\n", "a\nc\n", "@@ -1,3 +1,2 @@\n a\n-b\n c\n"},
+		{"added at end", "a\n", "a\nb\n", "@@ -1 +1,2 @@\n a\n+b\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			want := test.want
+			if want != "" {
+				want = "--- 1/site.conf\n+++ 2/site.conf\n" + want
+			}
+			got := unifiedDiff("1/site.conf", "2/site.conf", test.old, test.new)
+			if got != want {
+				t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestDiffMetadata(t *testing.T) {
+	oldProjects := projectsMetadataType{
+		"p1": {Version: "1", Domains: map[string]*projectDomainData{"a.com": {SslType: 1}}},
+		"p2": {Domains: map[string]*projectDomainData{"x.com": {}}},
+	}
+	newProjects := projectsMetadataType{
+		"p1": {Version: "2", Domains: map[string]*projectDomainData{"a.com": {SslType: 2, Redirect: true}, "b.com": {}}},
+		"p3": {},
+	}
+	want := metadataDiff{
+		ProjectsAdded:   []string{"p3"},
+		ProjectsRemoved: []string{"p2"},
+		DomainsAdded:    []string{"p1/b.com"},
+		DomainsRemoved:  []string{"p2/x.com"},
+		SslChanged:      []domainChange{{"p1/a.com", "1", "2"}},
+		RedirectChanged: []domainChange{{"p1/a.com", "false", "true"}},
+		VarsChanged:     []varChange{{"p1", "Version", "1", "2"}},
+	}
+	if got := diffMetadata(oldProjects, newProjects); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	empty := diffMetadata(newProjects, newProjects)
+	if len(empty.ProjectsAdded)+len(empty.ProjectsRemoved)+len(empty.DomainsAdded)+len(empty.DomainsRemoved)+
+		len(empty.SslChanged)+len(empty.RedirectChanged)+len(empty.VarsChanged) != 0 {
+		t.Fatalf("changes of equal metadata: %+v", empty)
+	}
+}
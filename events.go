@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Event types.
+const (
+	eventNodeAdded        = "node_added"
+	eventNodeRemoved      = "node_removed"
+	eventReceivedVersion  = "received_version_changed"
+	eventLoadedVersion    = "loaded_version_changed"
+	eventRolloutProgress  = "rollout_progress"
+	eventVersionPublished = "version_published"
+)
+
+// Controller event, sent to /events subscribers as JSON.
+type controllerEvent struct {
+	Type       string      `json:"type"`
+	Time       int64       `json:"time"`
+	Node       string      `json:"node,omitempty"`
+	Version    int         `json:"version,omitempty"`
+	OldVersion int         `json:"old_version,omitempty"`
+	Data       interface{} `json:"data,omitempty"`
+}
+
+// Rollout progress event data.
+type rolloutEventData struct {
+	Status string   `json:"status"`
+	Wave   int      `json:"wave"`
+	Waves  int      `json:"waves"`
+	Nodes  []string `json:"nodes,omitempty"`
+}
+
+// Events subscribers. Slow subscribers lose events instead of blocking controller.
+var eventSubscribers = make(map[chan controllerEvent]bool)
+var eventSubscribersLock sync.Mutex
+
+var wsUpgrader = websocket.Upgrader{}
+
+// Send event to all subscribers.
+func publishEvent(event controllerEvent) {
+	event.Time = time.Now().Unix()
+	eventSubscribersLock.Lock()
+	defer eventSubscribersLock.Unlock()
+	for ch := range eventSubscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Add events subscriber.
+func subscribeEvents() chan controllerEvent {
+	ch := make(chan controllerEvent, 64)
+	eventSubscribersLock.Lock()
+	eventSubscribers[ch] = true
+	eventSubscribersLock.Unlock()
+	return ch
+}
+
+// Remove events subscriber.
+func unsubscribeEvents(ch chan controllerEvent) {
+	eventSubscribersLock.Lock()
+	delete(eventSubscribers, ch)
+	eventSubscribersLock.Unlock()
+}
+
+// Endpoint /events
+// Server-sent events stream of nodes and rollout state changes.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported.", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	flusher.Flush()
+
+	ch := subscribeEvents()
+	defer unsubscribeEvents(ch)
+	// Keep alive comments for proxies.
+	ping := time.NewTicker(30 * time.Second)
+	defer ping.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-shuttingDown:
+			return
+		case <-ping.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case event := <-ch:
+			data, err := json.Marshal(event)
+			if err != nil {
+				log.Println(err.Error())
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+		}
+		flusher.Flush()
+	}
+}
+
+// Endpoint /events/ws
+// Same events stream over WebSocket, one JSON event per message.
+func eventsWsHandler(w http.ResponseWriter, r *http.Request) {
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("WebSocket upgrade error: %s", err.Error())
+		return
+	}
+	defer conn.Close()
+	// Read loop to process close and ping messages from client.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ch := subscribeEvents()
+	defer unsubscribeEvents(ch)
+	for {
+		select {
+		case <-closed:
+			return
+		case <-shuttingDown:
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "shutdown"))
+			return
+		case event := <-ch:
+			if err := conn.WriteJSON(event); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var retentionKeep = flag.Int64("retention.keep",
+	getEnvInt64("RETENTION_KEEP", 20),
+	"Count of last versions to keep in conf.pkg.dir (at least 1).")
+
+var retentionAge = flag.Int64("retention.age",
+	getEnvInt64("RETENTION_AGE", 7*24*3600),
+	"Seconds to keep versions in conf.pkg.dir.")
+
+var retentionInterval = flag.Int64("retention.interval",
+	getEnvInt64("RETENTION_INTERVAL", 3600),
+	"Seconds between old versions cleanups. 0 - disabled.")
+
+// Retention reasons to keep version.
+const (
+	keepLast     = "last"
+	keepAge      = "age"
+	keepNode     = "node"
+	keepPinned   = "pinned"
+	keepLastGood = "last_good"
+	keepRollout  = "rollout"
+)
+
+// Version files in conf.pkg.dir.
+type storedVersion struct {
+	Version int      `json:"version"`
+	Created int64    `json:"created"`
+	Size    int64    `json:"size"`
+	Reasons []string `json:"reasons,omitempty"`
+	// File name - size.
+	files map[string]int64
+}
+
+// Versions to keep and delete.
+type retentionPlan struct {
+	Keep   []*storedVersion `json:"keep"`
+	Delete []*storedVersion `json:"delete"`
+}
+
+// Only one cleanup at a time.
+var gcLock sync.Mutex
+
+// Marker file of pinned version, it's stored with versions files.
+func pinnedVersionFile(version int) string {
+	return fmt.Sprintf("%s/%d.pinned", *configsPkgsDir, version)
+}
+
+// Return true if version is pinned.
+func isVersionPinned(version int) bool {
+	_, err := os.Stat(pinnedVersionFile(version))
+	return err == nil
+}
+
+// Find versions files: full (gzip, zstd) and delta packages, manifests and signatures of all groups, info and bad marker.
+func storedVersions() (map[int]*storedVersion, error) {
+	versions := make(map[int]*storedVersion)
+	addFile := func(file storeFileInfo, version int) {
+		stored, ok := versions[version]
+		if !ok {
+			stored = &storedVersion{Version: version, files: make(map[string]int64)}
+			versions[version] = stored
+		}
+		if _, ok := stored.files[file.Path]; ok {
+			return
+		}
+		stored.files[file.Path] = file.Size
+		stored.Size += file.Size
+		if file.ModTime.Unix() > stored.Created {
+			stored.Created = file.ModTime.Unix()
+		}
+	}
+	dirs := []string{*configsPkgsDir}
+	for _, group := range nodeGroupNames() {
+		if dir := groupDir(*configsPkgsDir, group); dir != *configsPkgsDir {
+			dirs = append(dirs, dir)
+		}
+	}
+	for _, dir := range dirs {
+		// Stored files and local files (markers and not yet stored files), the same file is counted once.
+		files, err := packageStore.List(dir)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := packageStore.(localPackageStore); !ok {
+			localFiles, err := localPackageStore{}.List(dir)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, localFiles...)
+		}
+		for _, file := range files {
+			// Signatures are deleted with signed files.
+			name := strings.TrimSuffix(filepath.Base(file.Path), ".sig")
+			// Delta packages '<version>_<from>.delta.tar.gz' are deleted with version.
+			if strings.HasSuffix(name, ".delta.tar.gz") {
+				if version, err := strconv.Atoi(strings.SplitN(name, "_", 2)[0]); err == nil {
+					addFile(file, version)
+				}
+				continue
+			}
+			for _, suffix := range []string{".tar.gz", ".tar.zst", ".json", ".manifest.json", ".bad"} {
+				if !strings.HasSuffix(name, suffix) {
+					continue
+				}
+				if version, err := strconv.Atoi(strings.TrimSuffix(name, suffix)); err == nil {
+					addFile(file, version)
+				}
+			}
+		}
+	}
+	// Creation time from version info is more precise than files time.
+	for version, stored := range versions {
+		if info, err := loadVersionInfo(version); err == nil && info.Created > 0 {
+			stored.Created = info.Created
+		}
+	}
+	return versions, nil
+}
+
+// Versions used by nodes, current rollout and last good version.
+func usedVersions() map[int]string {
+	used := make(map[int]string)
+	serversLock.RLock()
+	for _, state := range serversState {
+		used[state.CurentConfVersion] = keepNode
+		used[state.ReceivedConfVersion] = keepNode
+	}
+	serversLock.RUnlock()
+	rolloutLock.Lock()
+	if rollout != nil {
+		used[rollout.Version] = keepRollout
+		used[rollout.StableVersion] = keepRollout
+	}
+	rolloutLock.Unlock()
+	used[getLastGoodVersion()] = keepLastGood
+	return used
+}
+
+// Split stored versions to kept and deleted by retention policy.
+func retentionPlanFor(versions map[int]*storedVersion, used map[int]string, now int64) retentionPlan {
+	var sorted []int
+	for version := range versions {
+		sorted = append(sorted, version)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(sorted)))
+	keep := int(*retentionKeep)
+	if keep < 1 {
+		keep = 1
+	}
+	plan := retentionPlan{Keep: []*storedVersion{}, Delete: []*storedVersion{}}
+	for i, version := range sorted {
+		stored := versions[version]
+		if i < keep {
+			stored.Reasons = append(stored.Reasons, keepLast)
+		}
+		if now-stored.Created < *retentionAge {
+			stored.Reasons = append(stored.Reasons, keepAge)
+		}
+		if reason, ok := used[version]; ok {
+			stored.Reasons = append(stored.Reasons, reason)
+		}
+		if isVersionPinned(version) {
+			stored.Reasons = append(stored.Reasons, keepPinned)
+		}
+		if len(stored.Reasons) > 0 {
+			plan.Keep = append(plan.Keep, stored)
+		} else {
+			plan.Delete = append(plan.Delete, stored)
+		}
+	}
+	return plan
+}
+
+// Build current retention plan.
+func getRetentionPlan() (retentionPlan, error) {
+	versions, err := storedVersions()
+	if err != nil {
+		return retentionPlan{}, err
+	}
+	return retentionPlanFor(versions, usedVersions(), time.Now().Unix()), nil
+}
+
+// Delete versions not needed by retention policy.
+func sweepVersions() (retentionPlan, error) {
+	gcLock.Lock()
+	defer gcLock.Unlock()
+	gcRunsTotal.Inc()
+	plan, err := getRetentionPlan()
+	if err != nil {
+		log.Printf("Old versions cleanup failed: %s", err.Error())
+		return plan, err
+	}
+	for _, stored := range plan.Delete {
+		for file, size := range stored.files {
+			if err := deleteStoredFile(file); err != nil {
+				log.Printf("Can't delete %s: %s", file, err.Error())
+				continue
+			}
+			gcDeletedBytesTotal.Add(float64(size))
+		}
+		gcDeletedVersionsTotal.Inc()
+		log.Printf("Version %d deleted by retention policy.", stored.Version)
+	}
+	var keptSize int64
+	for _, stored := range plan.Keep {
+		keptSize += stored.Size
+	}
+	gcKeptVersions.Set(float64(len(plan.Keep)))
+	gcKeptBytes.Set(float64(keptSize))
+	gcLastRunTimestamp.SetToCurrentTime()
+	return plan, nil
+}
+
+// Periodically delete old versions.
+func versionsSweeper() {
+	if *retentionInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(*retentionInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-shuttingDown:
+			return
+		case <-ticker.C:
+			sweepVersions()
+		}
+	}
+}
+
+// Endpoint GET /gc
+// Dry run: list versions to keep (with reasons) and to delete.
+// Request example: http://controller-host:8081/gc
+func gcPlanHandler(w http.ResponseWriter, r *http.Request) {
+	plan, err := getRetentionPlan()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(plan)
+}
+
+// Endpoint POST /gc
+// Delete old versions now and return what was done.
+func gcRunHandler(w http.ResponseWriter, r *http.Request) {
+	plan, err := sweepVersions()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(plan)
+}
+
+// Endpoint PUT/DELETE /versions/{version}/pin
+// Pin version to keep it forever, or unpin.
+func pinVersionHandler(w http.ResponseWriter, r *http.Request) {
+	version, err := strconv.Atoi(mux.Vars(r)["version"])
+	if err != nil {
+		http.Error(w, "Bad version number.", 400)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		err = deleteStoredFile(pinnedVersionFile(version))
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		log.Printf("Version %d unpinned by %s", version, requestIdentity(r))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err = ensureLocal(fmt.Sprintf("%s/%d.tar.gz", groupDir(*configsPkgsDir, *defaultGroup), version)); err != nil {
+		http.Error(w, "Version not found.", 404)
+		return
+	}
+	err = ioutil.WriteFile(pinnedVersionFile(version), []byte(requestIdentity(r)+"\n"), os.FileMode(0644))
+	if err == nil {
+		err = storeFiles(pinnedVersionFile(version))
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	log.Printf("Version %d pinned by %s", version, requestIdentity(r))
+	w.WriteHeader(http.StatusNoContent)
+}
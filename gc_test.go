@@ -0,0 +1,161 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// Set retention flags for test.
+func testRetention(t *testing.T, keep, age int64) {
+	oldKeep, oldAge := *retentionKeep, *retentionAge
+	*retentionKeep, *retentionAge = keep, age
+	t.Cleanup(func() { *retentionKeep, *retentionAge = oldKeep, oldAge })
+}
+
+// Versions numbers of plan part.
+func planVersions(list []*storedVersion) []int {
+	versions := []int{}
+	for _, stored := range list {
+		versions = append(versions, stored.Version)
+	}
+	sort.Ints(versions)
+	return versions
+}
+
+func TestRetentionPlanFor(t *testing.T) {
+	tests := []struct {
+		name    string
+		keep    int64
+		age     int64
+		used    map[int]string
+		pinned  []int
+		kept    []int
+		deleted []int
+		reasons map[int][]string
+	}{
+		{
+			name: "last versions only", keep: 3, age: 0,
+			kept: []int{8, 9, 10}, deleted: []int{1, 2, 3, 4, 5, 6, 7},
+			reasons: map[int][]string{10: {keepLast}},
+		},
+		{
+			name: "at least one version is kept", keep: 0, age: 0,
+			kept: []int{10}, deleted: []int{1, 2, 3, 4, 5, 6, 7, 8, 9},
+		},
+		{
+			name: "young versions", keep: 1, age: 250,
+			// Version v is created at v*100, now is 1000.
+			kept: []int{8, 9, 10}, deleted: []int{1, 2, 3, 4, 5, 6, 7},
+			reasons: map[int][]string{10: {keepLast, keepAge}, 9: {keepAge}},
+		},
+		{
+			name: "used and pinned versions", keep: 2, age: 0,
+			used:   map[int]string{2: keepNode, 4: keepLastGood, 6: keepRollout},
+			pinned: []int{1},
+			kept:   []int{1, 2, 4, 6, 9, 10}, deleted: []int{3, 5, 7, 8},
+			reasons: map[int][]string{1: {keepPinned}, 2: {keepNode}, 4: {keepLastGood}, 6: {keepRollout}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testPkgsDir(t)
+			testRetention(t, test.keep, test.age)
+			for _, version := range test.pinned {
+				if err := ioutil.WriteFile(pinnedVersionFile(version), nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			versions := make(map[int]*storedVersion)
+			for version := 1; version <= 10; version++ {
+				versions[version] = &storedVersion{Version: version, Created: int64(version * 100)}
+			}
+			plan := retentionPlanFor(versions, test.used, 1000)
+			if kept := planVersions(plan.Keep); !reflect.DeepEqual(kept, test.kept) {
+				t.Fatalf("kept %v, want %v", kept, test.kept)
+			}
+			if deleted := planVersions(plan.Delete); !reflect.DeepEqual(deleted, test.deleted) {
+				t.Fatalf("deleted %v, want %v", deleted, test.deleted)
+			}
+			for version, reasons := range test.reasons {
+				if !reflect.DeepEqual(versions[version].Reasons, reasons) {
+					t.Fatalf("version %d reasons %v, want %v", version, versions[version].Reasons, reasons)
+				}
+			}
+		})
+	}
+}
+
+func TestStoredVersions(t *testing.T) {
+	dir := testPkgsDir(t)
+	files := map[string]string{
+		"5.tar.gz":             "12345",
+		"5.tar.gz.sig":         "12",
+		"5.tar.zst":            "123",
+		"5.manifest.json":      "1",
+		"5.json":               "{}",
+		"6.tar.gz":             "123456",
+		"6_5.delta.tar.gz":     "12",
+		"6_5.delta.tar.gz.sig": "1",
+		"6.bad":                "failed",
+		"audit.log":            "not a version",
+		"last_good_version":    "5",
+		"7.pinned":             "",
+	}
+	writeTestFiles(t, dir, files)
+	versions, err := storedVersions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 {
+		t.Fatalf("versions: %v", versions)
+	}
+	want := map[int][]string{
+		5: {"5.json", "5.manifest.json", "5.tar.gz", "5.tar.gz.sig", "5.tar.zst"},
+		6: {"6.bad", "6.tar.gz", "6_5.delta.tar.gz", "6_5.delta.tar.gz.sig"},
+	}
+	for version, names := range want {
+		stored := versions[version]
+		var got []string
+		var size int64
+		for file := range stored.files {
+			got = append(got, filepath.Base(file))
+			size += int64(len(files[filepath.Base(file)]))
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, names) {
+			t.Fatalf("version %d files %v, want %v", version, got, names)
+		}
+		if stored.Size != size {
+			t.Fatalf("version %d size %d, want %d", version, stored.Size, size)
+		}
+	}
+}
+
+func TestSweepVersions(t *testing.T) {
+	dir := testPkgsDir(t)
+	testRetention(t, 1, 0)
+	writeTestFiles(t, dir, map[string]string{
+		"1.tar.gz": "old", "1.tar.gz.sig": "old", "1.json": "{}",
+		"2.tar.gz": "new", "2.json": "{}",
+		"audit.log": "log",
+	})
+	if _, err := sweepVersions(); err != nil {
+		t.Fatal(err)
+	}
+	files := readTestFiles(t, dir)
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if !reflect.DeepEqual(names, []string{"2.json", "2.tar.gz", "audit.log"}) {
+		t.Fatalf("files after sweep: %v", names)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "1.tar.gz")); !os.IsNotExist(err) {
+		t.Fatal("old version is not deleted")
+	}
+}
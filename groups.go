@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Node group description from groups file.
+// Node gets the first group whose selector labels all match node labels.
+type nodeGroup struct {
+	Name     string            `json:"name"`
+	Selector map[string]string `json:"selector"`
+}
+
+// Groups file format.
+// Example: {"groups": [{"name": "public", "selector": {"pool": "public"}}, {"name": "internal"}]}
+type nodeGroupsConfig struct {
+	Groups []nodeGroup `json:"groups"`
+}
+
+// List of configured node groups (empty - groups disabled, all nodes in default group).
+// List is replaced on reload, never changed in place.
+var nodeGroups []nodeGroup
+var nodeGroupsLock sync.RWMutex
+
+var groupsFile = flag.String("groups.file",
+	getEnv("GROUPS_FILE", ""),
+	"JSON file with lb node groups. Empty - single group for all nodes.")
+
+var defaultGroup = flag.String("groups.default",
+	getEnv("GROUPS_DEFAULT", "default"),
+	"Group for nodes without group and projects without groups metadata.")
+
+// Read node groups list from groups file.
+func loadNodeGroups() error {
+	if *groupsFile == "" {
+		setNodeGroups(nil)
+		return nil
+	}
+	data, err := ioutil.ReadFile(*groupsFile)
+	if err != nil {
+		log.Printf("Can't read groups file: %s", err.Error())
+		return err
+	}
+	var conf nodeGroupsConfig
+	err = json.Unmarshal(data, &conf)
+	if err != nil {
+		log.Printf("Can't parse groups file: %s", err.Error())
+		return err
+	}
+	setNodeGroups(conf.Groups)
+	log.Printf("Node groups loaded: %s", strings.Join(nodeGroupNames(), ", "))
+	return nil
+}
+
+// Get configured node groups.
+func getNodeGroups() []nodeGroup {
+	nodeGroupsLock.RLock()
+	defer nodeGroupsLock.RUnlock()
+	return nodeGroups
+}
+
+// Replace configured node groups.
+func setNodeGroups(groups []nodeGroup) {
+	nodeGroupsLock.Lock()
+	defer nodeGroupsLock.Unlock()
+	nodeGroups = groups
+}
+
+// Return true if node groups are configured.
+func groupsEnabled() bool {
+	return len(getNodeGroups()) > 0
+}
+
+// Names of all groups configs are generated for. Default group is always present.
+func nodeGroupNames() []string {
+	names := []string{*defaultGroup}
+	for _, group := range getNodeGroups() {
+		if group.Name != *defaultGroup {
+			names = append(names, group.Name)
+		}
+	}
+	return names
+}
+
+// Return true if group with name exists.
+func nodeGroupExists(name string) bool {
+	for _, group := range nodeGroupNames() {
+		if group == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Per group subdirectory of base dir. Without groups - base dir itself.
+func groupDir(base, group string) string {
+	if !groupsEnabled() {
+		return base
+	}
+	return filepath.Join(base, group)
+}
+
+// Get group for node. Requested group has priority, then label selectors, then default group.
+func matchNodeGroup(requested string, labels map[string]string) string {
+	if requested != "" {
+		if nodeGroupExists(requested) {
+			return requested
+		}
+		log.Printf("Unknown node group requested: %s", requested)
+	}
+	for _, group := range getNodeGroups() {
+		if len(group.Selector) == 0 {
+			continue
+		}
+		matched := true
+		for key, val := range group.Selector {
+			if labels[key] != val {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return group.Name
+		}
+	}
+	return *defaultGroup
+}
+
+// Parse node labels in format 'key1=val1,key2=val2'.
+func parseNodeLabels(labelsStr string) map[string]string {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(labelsStr, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			continue
+		}
+		labels[kv[0]] = kv[1]
+	}
+	return labels
+}
+
+// Filter projects assigned to group. Projects without groups metadata go to default group.
+func projectsForGroup(projects projectsMetadataType, group string) projectsMetadataType {
+	if !groupsEnabled() {
+		return projects
+	}
+	result := make(projectsMetadataType)
+	for uuid, project := range projects {
+		projectGroups := project.Groups
+		if len(projectGroups) == 0 {
+			projectGroups = []string{*defaultGroup}
+		}
+		for _, name := range projectGroups {
+			if name == group {
+				result[uuid] = project
+				break
+			}
+		}
+	}
+	return result
+}
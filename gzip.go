@@ -2,31 +2,146 @@ package main
 
 import (
 	"archive/tar"
+	"bufio"
 	"bytes"
 	"compress/gzip"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Package formats.
+const (
+	formatGzip = "gzip"
+	formatZstd = "zstd"
 )
 
-// gzip directory
-func compress(src, gzipfile string) error {
-	// tar > gzip > buf
-	var buf bytes.Buffer
-	zr := gzip.NewWriter(&buf)
-	tw := tar.NewWriter(zr)
+// Package file extension and content type by format.
+var packageExts = map[string]string{formatGzip: ".tar.gz", formatZstd: ".tar.zst"}
+var packageContentTypes = map[string]string{formatGzip: "application/gzip", formatZstd: "application/zstd"}
+
+// Package file name of group version.
+func packageFileName(group string, version int, format string) string {
+	return fmt.Sprintf("%s/%d%s", groupDir(*configsPkgsDir, group), version, packageExts[format])
+}
+
+// Archive entries time, fixed to make tar stream depend on files content only.
+var tarEntryTime = time.Unix(0, 0)
+
+// tar directory to gzip and zstd packages '<pkgPrefix>.tar.gz' and '<pkgPrefix>.tar.zst'.
+// Manifest (if not empty) is the first archive entry.
+// Both packages are made from the same tar stream. Each is written to temp file in the same dir
+// and renamed, so readers never see partial package.
+func compress(src, pkgPrefix string, manifest []byte) (Error error) {
+	gzipFile, err := ioutil.TempFile(filepath.Dir(pkgPrefix), filepath.Base(pkgPrefix)+".tmp")
+	if err != nil {
+		return err
+	}
+	zstdFile, err := ioutil.TempFile(filepath.Dir(pkgPrefix), filepath.Base(pkgPrefix)+".tmp")
+	if err != nil {
+		gzipFile.Close()
+		os.Remove(gzipFile.Name())
+		return err
+	}
+	defer func() {
+		// Close is safe to repeat, temp files are removed on any error.
+		for _, file := range []*os.File{gzipFile, zstdFile} {
+			file.Close()
+			if Error != nil {
+				os.Remove(file.Name())
+			}
+		}
+	}()
+	// tar > gzip, zstd > temp files
+	zr := gzip.NewWriter(gzipFile)
+	zw, err := zstd.NewWriter(zstdFile)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(io.MultiWriter(zr, zw))
+	err = writeTar(tw, src, manifest)
+	if err != nil {
+		zw.Close()
+		return err
+	}
+
+	// produce tar
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	// produce gzip and zstd
+	if err := zr.Close(); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	files := []*os.File{gzipFile, zstdFile}
+	for _, file := range files {
+		// flush to disk before rename
+		if err := file.Sync(); err != nil {
+			return err
+		}
+		if err := file.Close(); err != nil {
+			return err
+		}
+		if err := os.Chmod(file.Name(), os.FileMode(0644)); err != nil {
+			return err
+		}
+	}
+	// gzip is renamed first and removed if zstd rename fails, so version never has only one format.
+	for i, format := range []string{formatGzip, formatZstd} {
+		if err := os.Rename(files[i].Name(), pkgPrefix+packageExts[format]); err != nil {
+			for _, renamed := range []string{formatGzip, formatZstd}[:i] {
+				os.Remove(pkgPrefix + packageExts[renamed])
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Write manifest and every file of src dir to tar.
+// Owner and time are not saved, so the same files give the same tar stream.
+func writeTar(tw *tar.Writer, src string, manifest []byte) error {
+	if len(manifest) > 0 {
+		header := &tar.Header{Name: manifestName, Mode: 0644, Size: int64(len(manifest)), ModTime: tarEntryTime, Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := tw.Write(manifest); err != nil {
+			return err
+		}
+	}
 
-	// walk through every file in the folder
-	filepath.Walk(src, func(file string, fi os.FileInfo, err error) error {
+	// walk through every file in the folder (in lexical order)
+	return filepath.Walk(src, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
 		// generate tar header
 		header, err := tar.FileInfoHeader(fi, file)
 		if err != nil {
 			return err
 		}
 
-		// must provide real name
+		// must provide real name, relative to src dir
 		// (see https://golang.org/src/archive/tar/common.go?#L626)
-		header.Name = filepath.ToSlash(file)
+		rel, err := filepath.Rel(src, file)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		header.Name = filepath.ToSlash(rel)
+		header.ModTime, header.AccessTime, header.ChangeTime = tarEntryTime, time.Time{}, time.Time{}
+		header.Uid, header.Gid, header.Uname, header.Gname = 0, 0, "", ""
 
 		// write header
 		if err := tw.WriteHeader(header); err != nil {
@@ -38,31 +153,28 @@ func compress(src, gzipfile string) error {
 			if err != nil {
 				return err
 			}
+			defer data.Close()
 			if _, err := io.Copy(tw, data); err != nil {
 				return err
 			}
 		}
 		return nil
 	})
+}
 
-	// produce tar
-	if err := tw.Close(); err != nil {
-		return err
-	}
-	// produce gzip
-	if err := zr.Close(); err != nil {
-		return err
-	}
-	//
-
-	// tar + gzip
-	// write the .tar.gzip
-	fileToWrite, err := os.OpenFile(gzipfile, os.O_RDWR|os.O_CREATE, os.FileMode(0666))
+// Uncompressed tar stream of gzip or zstd package, format is detected by magic bytes.
+func decompress(pkg io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(pkg)
+	magic, err := br.Peek(4)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	if _, err := io.Copy(fileToWrite, &buf); err != nil {
-		panic(err)
+	if bytes.Equal(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}) {
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
 	}
-	return nil
+	return gzip.NewReader(br)
 }
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Write conf.d like tree: per project server blocks with upstreams, ssl and locations.
+func writeTestConfD(tb testing.TB, dir string, projects int) {
+	for i := 0; i < projects; i++ {
+		var conf strings.Builder
+		fmt.Fprintf(&conf, "upstream project%d_backend {\n", i)
+		for j := 1; j <= 3; j++ {
+			fmt.Fprintf(&conf, "    server 10.%d.%d.%d:8080 max_fails=3 fail_timeout=10s;\n", i/250, i%250, j)
+		}
+		conf.WriteString("    keepalive 32;\n}\n\n")
+		for _, domain := range []string{"project%d.example.com", "www.project%d.example.com", "api.project%d.example.com"} {
+			name := fmt.Sprintf(domain, i)
+			fmt.Fprintf(&conf, "server {\n    listen 443 ssl http2;\n    server_name %s;\n", name)
+			fmt.Fprintf(&conf, "    ssl_certificate /etc/nginx/ssl/%s.crt;\n    ssl_certificate_key /etc/nginx/ssl/%s.key;\n", name, name)
+			conf.WriteString("    access_log /var/log/nginx/access.log main;\n    client_max_body_size 20m;\n")
+			for _, location := range []string{"/", "/static/", "/api/"} {
+				fmt.Fprintf(&conf, "    location %s {\n", location)
+				fmt.Fprintf(&conf, "        proxy_pass http://project%d_backend;\n", i)
+				conf.WriteString("        proxy_set_header Host $host;\n        proxy_set_header X-Real-IP $remote_addr;\n")
+				conf.WriteString("        proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;\n        proxy_read_timeout 60s;\n    }\n")
+			}
+			conf.WriteString("}\n\n")
+		}
+		name := filepath.Join(dir, "sites", fmt.Sprintf("project%d.conf", i))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			tb.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(conf.String()), 0644); err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCompress(b *testing.B) {
+	src := b.TempDir()
+	writeTestConfD(b, src, 500)
+	// Tar stream of conf.d, the same compress writes to both packages.
+	var stream bytes.Buffer
+	tw := tar.NewWriter(&stream)
+	if err := writeTar(tw, src, nil); err != nil {
+		b.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		b.Fatal(err)
+	}
+	writers := map[string]func(io.Writer) (io.WriteCloser, error){
+		formatGzip: func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil },
+		formatZstd: func(w io.Writer) (io.WriteCloser, error) { return zstd.NewWriter(w) },
+	}
+	for _, format := range []string{formatGzip, formatZstd} {
+		b.Run(format, func(b *testing.B) {
+			var out bytes.Buffer
+			b.SetBytes(int64(stream.Len()))
+			for i := 0; i < b.N; i++ {
+				out.Reset()
+				zw, err := writers[format](&out)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err = zw.Write(stream.Bytes()); err != nil {
+					b.Fatal(err)
+				}
+				if err = zw.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(stream.Len()), "tar-bytes")
+			b.ReportMetric(float64(out.Len()), "pkg-bytes")
+		})
+	}
+	// Both packages with files walk and temp files, as packaging does.
+	b.Run("compress", func(b *testing.B) {
+		prefix := filepath.Join(b.TempDir(), "1")
+		b.SetBytes(int64(stream.Len()))
+		for i := 0; i < b.N; i++ {
+			if err := compress(src, prefix, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestCompressDeterministic(t *testing.T) {
+	src := t.TempDir()
+	writeTestConfD(t, src, 20)
+	manifest := []byte(`{"version":1}`)
+	first, second := filepath.Join(t.TempDir(), "1"), filepath.Join(t.TempDir(), "1")
+	if err := compress(src, first, manifest); err != nil {
+		t.Fatal(err)
+	}
+	// Changed mtime must not change packages.
+	for _, name := range []string{src, filepath.Join(src, "sites", "project1.conf")} {
+		if err := os.Chtimes(name, tarEntryTime.AddDate(30, 0, 0), tarEntryTime.AddDate(30, 0, 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := compress(src, second, manifest); err != nil {
+		t.Fatal(err)
+	}
+	for _, format := range []string{formatGzip, formatZstd} {
+		a, err := ioutil.ReadFile(first + packageExts[format])
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadFile(second + packageExts[format])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(a, b) {
+			t.Fatalf("%s packages of the same tree differ", format)
+		}
+	}
+}
+
+// Failed rename of second package removes the first one, version doesn't have only one format.
+func TestCompressRenameFailure(t *testing.T) {
+	src := t.TempDir()
+	writeTestConfD(t, src, 2)
+	dir := t.TempDir()
+	prefix := filepath.Join(dir, "1")
+	// Non empty dir in place of zstd package can't be replaced by rename.
+	writeTestFiles(t, prefix+packageExts[formatZstd], map[string]string{"file": "data"})
+	if err := compress(src, prefix, nil); err == nil {
+		t.Fatal("compress with failed rename succeeded")
+	}
+	if _, err := os.Stat(prefix + packageExts[formatGzip]); !os.IsNotExist(err) {
+		t.Fatalf("gzip package is kept: %v", err)
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "*.tmp*"))
+	if err != nil || len(names) != 0 {
+		t.Fatalf("temp files are kept: %v, %v", names, err)
+	}
+}
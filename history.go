@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Version sources.
+const (
+	versionSourceUpdate   = "update"
+	versionSourceRollback = "rollback"
+)
+
+// Published version info, saved as <conf.pkg.dir>/<version>.json.
+type versionInfo struct {
+	Version        int                  `json:"version"`
+	Created        int64                `json:"created"`
+	Source         string               `json:"source"`
+	CopyOf         int                  `json:"copy_of,omitempty"`
+	JobId          string               `json:"job_id,omitempty"`
+	Identity       string               `json:"identity,omitempty"`
+	Bad            bool                 `json:"bad"`
+	TemplateHashes map[string]string    `json:"template_hashes"`
+	PackageHashes  map[string]string    `json:"package_hashes"`
+	Metadata       projectsMetadataType `json:"metadata"`
+}
+
+// Version info in /versions list, without metadata.
+type versionSummary struct {
+	Version       int               `json:"version"`
+	Created       int64             `json:"created"`
+	Source        string            `json:"source"`
+	CopyOf        int               `json:"copy_of,omitempty"`
+	Bad           bool              `json:"bad"`
+	Projects      int               `json:"projects"`
+	PackageHashes map[string]string `json:"package_hashes"`
+}
+
+// Value of redacted metadata fields.
+const redactedValue = "redacted"
+
+// Copy of metadata without service urls, they contain credentials.
+func redactMetadata(projects projectsMetadataType) projectsMetadataType {
+	result := make(projectsMetadataType)
+	for uuid, project := range projects {
+		redacted := *project
+		for _, field := range []*string{&redacted.DbMasterUrl, &redacted.DbSlaveUrl, &redacted.CacheUrl, &redacted.SessionsUrl, &redacted.LogUrl} {
+			if *field != "" {
+				*field = redactedValue
+			}
+		}
+		result[uuid] = &redacted
+	}
+	return result
+}
+
+// Version info file name.
+func versionInfoFile(version int) string {
+	return fmt.Sprintf("%s/%d.json", *configsPkgsDir, version)
+}
+
+// Hashes of templates, used for config generation.
+func templateHashes() map[string]string {
+	hashes := make(map[string]string)
+	for _, name := range []string{*vHostsTemplateFile, *vhostsSslTmpl, *vhostsNonSslTmpl} {
+		hash, err := fileHash(name)
+		if err != nil {
+			log.Printf("Can't get template hash: %s", err.Error())
+			continue
+		}
+		hashes[filepath.Base(name)] = hash
+	}
+	return hashes
+}
+
+// Save version info next to version packages.
+func saveVersionInfo(info versionInfo) error {
+	info.Created = time.Now().Unix()
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	tmpName := versionInfoFile(info.Version) + ".tmp"
+	err = ioutil.WriteFile(tmpName, data, os.FileMode(0644))
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpName, versionInfoFile(info.Version))
+	if err != nil {
+		return err
+	}
+	return storeFiles(versionInfoFile(info.Version))
+}
+
+// Load saved version info.
+func loadVersionInfo(version int) (*versionInfo, error) {
+	err := ensureLocal(versionInfoFile(version))
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(versionInfoFile(version))
+	if err != nil {
+		return nil, err
+	}
+	info := &versionInfo{}
+	err = json.Unmarshal(data, info)
+	if err != nil {
+		return nil, err
+	}
+	info.Bad = isVersionBad(version)
+	return info, nil
+}
+
+// Versions with saved info in store, newest first.
+func historyVersions() ([]int, error) {
+	files, err := packageStore.List(*configsPkgsDir)
+	if err != nil {
+		return nil, err
+	}
+	var versions []int
+	for _, file := range files {
+		name := filepath.Base(file.Path)
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		version, err := strconv.Atoi(strings.TrimSuffix(name, ".json"))
+		if err != nil {
+			continue
+		}
+		versions = append(versions, version)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(versions)))
+	return versions, nil
+}
+
+// Endpoint /versions
+// List published versions, newest first.
+// Request example: http://controller-host:8081/versions
+func versionsHandler(w http.ResponseWriter, r *http.Request) {
+	versions, err := historyVersions()
+	if err != nil && !os.IsNotExist(err) {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	list := []versionSummary{}
+	for _, version := range versions {
+		info, err := loadVersionInfo(version)
+		if err != nil {
+			log.Printf("Can't load version %d info: %s", version, err.Error())
+			continue
+		}
+		list = append(list, versionSummary{
+			Version:       info.Version,
+			Created:       info.Created,
+			Source:        info.Source,
+			CopyOf:        info.CopyOf,
+			Bad:           info.Bad,
+			Projects:      len(info.Metadata),
+			PackageHashes: info.PackageHashes,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// Endpoint /versions/{version}
+// Return version info with metadata snapshot. Service urls are redacted for non-operators.
+// Request example: http://controller-host:8081/versions/12345
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	version, err := strconv.Atoi(mux.Vars(r)["version"])
+	if err != nil {
+		http.Error(w, "Bad version number.", 400)
+		return
+	}
+	info, err := loadVersionInfo(version)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "Version not found.", 404)
+			return
+		}
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if requestRole(r) != roleOperator {
+		info.Metadata = redactMetadata(info.Metadata)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Job and stage statuses.
+const (
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// Update pipeline stage of job.
+type jobStage struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Started  int64  `json:"started"`
+	Duration int64  `json:"duration_ms"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Node convergence state after job publish.
+type jobNode struct {
+	Node           string `json:"node"`
+	Group          string `json:"group"`
+	TargetVersion  int    `json:"target_version"`
+	CurrentVersion int    `json:"current_version"`
+	Converged      bool   `json:"converged"`
+	LastError      string `json:"last_error,omitempty"`
+}
+
+// Config update job: new version, render, package and publish.
+type updateJob struct {
+	Id       string      `json:"id"`
+	Trigger  string      `json:"trigger"`
+	Status   string      `json:"status"`
+	Version  int         `json:"version"`
+	Started  int64       `json:"started"`
+	Finished int64       `json:"finished"`
+	Error    string      `json:"error,omitempty"`
+	Stages   []*jobStage `json:"stages"`
+	Nodes    []jobNode   `json:"nodes"`
+	// Closed when job is finished.
+	done chan struct{}
+	// Audit record, written when job is finished.
+	audit    auditRecord
+	metadata projectsMetadataType
+}
+
+// Max finished jobs kept in memory.
+const jobsHistorySize = 100
+
+// Jobs by id, running job and finished jobs order (for cleanup).
+var updateJobs = make(map[string]*updateJob)
+var runningJob *updateJob
+var finishedJobs []string
+var jobsLock sync.Mutex
+
+// Version number is taken and published under lock, so update job and rollbacks never get the same number.
+// Lock order: publishLock, then jobsLock (job stages and rollback handler running job check).
+var publishLock sync.Mutex
+
+var updateWaitTimeout = flag.Int64("update.wait.timeout",
+	getEnvInt64("UPDATE_WAIT_TIMEOUT", 30),
+	"Seconds update job waits for nodes to load new version.")
+
+// Start update job in background. If job is running already, return running job.
+// Trigger, identity and source ip of caller are saved to audit log.
+func startUpdateJob(trigger, identity, sourceIp string) (job *updateJob, started bool) {
+	jobsLock.Lock()
+	defer jobsLock.Unlock()
+	if runningJob != nil {
+		return runningJob, false
+	}
+	idBytes := make([]byte, 8)
+	rand.Read(idBytes)
+	job = &updateJob{
+		Id:      hex.EncodeToString(idBytes),
+		Trigger: trigger,
+		Status:  jobRunning,
+		Started: time.Now().Unix(),
+		done:    make(chan struct{}),
+		audit:   auditRecord{Trigger: trigger, Identity: identity, SourceIp: sourceIp},
+	}
+	updateJobs[job.Id] = job
+	runningJob = job
+	go runUpdateJob(job)
+	return job, true
+}
+
+// Get job by id.
+func getUpdateJob(id string) (*updateJob, bool) {
+	jobsLock.Lock()
+	defer jobsLock.Unlock()
+	job, ok := updateJobs[id]
+	return job, ok
+}
+
+// Update pipeline.
+// 1) Generate new configs from consul metadata.
+// 2) Get next config version number and make config pack.
+// 3) Update consul config version to notify all lb nodes that they need to update configs,
+// publish version (rollout) and wait for nodes to load it.
+// Version is published only when packages of all groups are written, signed and stored,
+// so failed job never leaves nodes with version without package.
+func runUpdateJob(job *updateJob) {
+	log.Printf("Update job %s started, trigger: %s", job.Id, job.Trigger)
+	updatesTotal.Inc()
+	var version int
+	var projectsMetadataJson []byte
+	var projectsMetadata projectsMetadataType
+	var templates map[string]string
+	err := runJobStage(job, stageConsulFetch, func() (err error) {
+		projectsMetadataJson, err = getConsulKvJson("clients")
+		return err
+	})
+	if err == nil {
+		err = runJobStage(job, stageParse, func() error {
+			projectsMetadata = parseConsulProjectsData(projectsMetadataJson)
+			if projectsMetadata == nil {
+				return fmt.Errorf("Can't parse projects metadata")
+			}
+			auditMetadata(&job.audit, projectsMetadata)
+			job.metadata = projectsMetadata
+			return nil
+		})
+	}
+	if err == nil {
+		err = runJobStage(job, stageRender, func() error {
+			templates = templateHashes()
+			return genConfig(projectsMetadata)
+		})
+	}
+	publishLock.Lock()
+	if err == nil {
+		err = runJobStage(job, "version", func() (err error) {
+			version, err = nextConsulConfVersion()
+			jobsLock.Lock()
+			job.Version = version
+			jobsLock.Unlock()
+			return err
+		})
+	}
+	if err == nil {
+		err = runJobStage(job, stagePackage, func() error {
+			err := pkgConfigs(version, templates)
+			if err != nil {
+				return err
+			}
+			job.audit.PackageHashes = packageHashes(version)
+			return saveVersionInfo(versionInfo{
+				Version:        version,
+				Source:         versionSourceUpdate,
+				JobId:          job.Id,
+				Identity:       job.audit.Identity,
+				TemplateHashes: templates,
+				PackageHashes:  job.audit.PackageHashes,
+				Metadata:       projectsMetadata,
+			})
+		})
+	}
+	if err == nil {
+		// Allow nodes to take new version (all at once or by rollout waves) and wait for them.
+		err = runJobStage(job, "publish", func() error {
+			if err := setConsulConfVersion(version); err != nil {
+				return err
+			}
+			startRollout(version)
+			return nil
+		})
+	}
+	publishLock.Unlock()
+	if err == nil {
+		runJobStage(job, "convergence", func() error {
+			waitForReload(*updateWaitTimeout, version)
+			return nil
+		})
+	}
+	finishUpdateJob(job, err)
+}
+
+// Run job stage and save its status and timings.
+func runJobStage(job *updateJob, name string, fn func() error) error {
+	stage := &jobStage{Name: name, Status: jobRunning, Started: time.Now().Unix()}
+	jobsLock.Lock()
+	job.Stages = append(job.Stages, stage)
+	jobsLock.Unlock()
+	start := time.Now()
+	err := fn()
+	jobsLock.Lock()
+	defer jobsLock.Unlock()
+	stage.Duration = time.Since(start).Milliseconds()
+	stage.Status = jobDone
+	if err != nil {
+		stage.Status = jobFailed
+		stage.Error = err.Error()
+		updateFailuresTotal.WithLabelValues(name).Inc()
+	}
+	return err
+}
+
+// Save job result and nodes convergence, allow next job.
+func finishUpdateJob(job *updateJob, err error) {
+	var nodes []jobNode
+	if err == nil {
+		for _, node := range getNodesStatus() {
+			nodes = append(nodes, jobNode{
+				Node:           node.Node,
+				Group:          node.Group,
+				TargetVersion:  node.TargetVersion,
+				CurrentVersion: node.CurrentVersion,
+				Converged:      node.CurrentVersion >= job.Version,
+				LastError:      node.LastError,
+			})
+		}
+	}
+	jobsLock.Lock()
+	defer jobsLock.Unlock()
+	job.Finished = time.Now().Unix()
+	job.Nodes = nodes
+	job.Status = jobDone
+	if err != nil {
+		job.Status = jobFailed
+		job.Error = err.Error()
+		log.Printf("Update job %s failed: %s", job.Id, err.Error())
+	} else {
+		log.Printf("Update job %s done, version: %d", job.Id, job.Version)
+	}
+	job.audit.JobId = job.Id
+	job.audit.Version = job.Version
+	job.audit.Outcome = job.Status
+	job.audit.Error = job.Error
+	writeAudit(job.audit)
+	if err == nil {
+		setAuditBaseline(job.metadata)
+	}
+	runningJob = nil
+	close(job.done)
+	// Forget old jobs.
+	finishedJobs = append(finishedJobs, job.Id)
+	if len(finishedJobs) > jobsHistorySize {
+		delete(updateJobs, finishedJobs[0])
+		finishedJobs = finishedJobs[1:]
+	}
+}
+
+// Write job as JSON.
+func writeJobJson(w http.ResponseWriter, job *updateJob, status int) {
+	jobsLock.Lock()
+	data, err := json.Marshal(job)
+	jobsLock.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// Endpoint POST /updates
+// Start update job and return its id. Request during running job returns running job.
+func createUpdateJobHandler(w http.ResponseWriter, r *http.Request) {
+	sourceIp, _, _ := net.SplitHostPort(r.RemoteAddr)
+	job, started := startUpdateJob("manual", requestIdentity(r), sourceIp)
+	if !started {
+		log.Printf("Update job %s is running, request coalesced.", job.Id)
+	}
+	w.Header().Set("Location", "/updates/"+job.Id)
+	writeJobJson(w, job, http.StatusAccepted)
+}
+
+// Endpoint GET /updates/{id}
+// Return job stages, timings, errors and nodes convergence.
+func getUpdateJobHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := getUpdateJob(mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, "Job not found.", 404)
+		return
+	}
+	writeJobJson(w, job, http.StatusOK)
+}
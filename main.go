@@ -1,18 +1,22 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // Nginx lb state.
@@ -22,6 +26,16 @@ type ServerInfo struct {
 	CurentConfVersion    int
 	ReceivedConfVersion  int
 	LastErr              error
+	Group                string
+	Labels               map[string]string
+	// Node ip, node key in list is ip or client certificate name.
+	Addr string
+	// Data from node reports (see /report).
+	LastReportTime int64
+	LastReloadTime int64
+	ConfHash       string
+	ConfTestOk     bool
+	ConfTestOutput string
 }
 
 // A part of project struct, descride domain.
@@ -44,14 +58,18 @@ type projectMetadata struct {
 	DevMode      string
 	FrontendPath string
 	RootPath     string
+	Groups       []string
 }
 
 type projectsMetadataType map[string]*projectMetadata
 
-// List of active nginx lbs (ip - state).
+// List of active nginx lbs (ip or client certificate name - state).
 var serversState = make(map[string]*ServerInfo)
 var serversStateOld = make(map[string]*ServerInfo)
 
+// Lock for serversState, list is used by handlers, list processing and rollouts.
+var serversLock sync.RWMutex
+
 // remove server from list after serverTimeout unseen seconds
 var serverTimeout int64 = 120
 
@@ -86,32 +104,53 @@ var vhostsSslTmpl = flag.String("vhosts.ssl.tmpl",
 var vhostsNonSslTmpl = flag.String("vhosts.non.ssl.tmpl",
 	getEnv("VHOSTS_NON_SSL_TMPL", "/conf/vhost_non_ssl.tmpl"),
 	"Template for non ssl virtualhost section.")
-	
+
 func main() {
 
-	//	package main
+	// Node agent mode: 'lb-confgs-controller agent [flags]'.
+	if len(os.Args) > 1 && os.Args[1] == "agent" {
+		runAgent(os.Args[2:])
+		return
+	}
+	// Signing key generation: 'lb-confgs-controller keygen [key id]'.
+	if len(os.Args) > 1 && os.Args[1] == "keygen" {
+		runKeygen(os.Args[2:])
+		return
+	}
 	flag.Parse()
-	testTmpl()
-	return
-	// Start registered servers list processing.
-	go serverListProcessing()
-
-	// Generate and update config every time after start.
-	time.Sleep(time.Second * 3)
-	version, err := incrConsulConfVersion()
+	err := loadNodeGroups()
 	if err != nil {
 		log.Fatalln(err.Error())
 	}
-	projectsMetadataJson, err := getConsulKvJson("clients")
-	projectsMetadata := parseConsulProjectsData(projectsMetadataJson)
-	err = genConfig(projectsMetadata)
-	if err != nil {
+	initPackageStore()
+	if err = loadVersionMarkers(); err != nil {
 		log.Fatalln(err.Error())
 	}
-	pkgConfigs(version)
+	loadLastGoodVersion()
+	loadAuditBaseline()
+	initAuth()
+	if err = loadSigningKeys(); err != nil {
+		log.Fatalln(err.Error())
+	}
+	loadState()
+	// Start registered servers list processing.
+	go serverListProcessing()
+	// Delete old versions by retention policy.
+	go versionsSweeper()
+
+	// Generate and update config every time after start.
+	time.Sleep(time.Second * 3)
+	job, _ := startUpdateJob("startup", "controller", "")
+	go func() {
+		<-job.done
+		if job.Status == jobFailed {
+			log.Fatalln(job.Error)
+		}
+	}()
 
-	// Start http server.
-	startListen()
+	// Start http server and wait for signals.
+	server := startListen()
+	handleSignals(server)
 
 }
 
@@ -121,35 +160,56 @@ func serverListProcessing() {
 	var tick = make(<-chan time.Time)
 	tick = time.Tick(4 * time.Second)
 	// serversStateOld - copy of serversState to get diff between checks (only for logs)
+	serversLock.RLock()
 	for host, state := range serversState {
-		serversStateOld[host] = &ServerInfo{0, 0, state.CurentConfVersion, state.ReceivedConfVersion, nil}
+		serversStateOld[host] = &ServerInfo{CurentConfVersion: state.CurentConfVersion, ReceivedConfVersion: state.ReceivedConfVersion}
 	}
+	serversLock.RUnlock()
 	for {
 		// Wait for tick.
 		curentTime := <-tick
 
-		for host, state := range serversState {
-			if curentTime.Unix()-state.LastSeenTime > serverTimeout {
+		for _, host := range sortedServerHosts() {
+			serversLock.Lock()
+			state, ok := serversState[host]
+			nodeAddr := host
+			if ok && state.Addr != "" {
+				nodeAddr = state.Addr
+			}
+			if ok && curentTime.Unix()-state.LastSeenTime > serverTimeout {
 				// Remove server if old seen.
 				log.Printf("Node %s removed from list. Curent: %d, LastSeen: %d, diff: %d", host, curentTime.Unix(), state.LastSeenTime, curentTime.Unix()-state.LastSeenTime)
+				publishEvent(controllerEvent{Type: eventNodeRemoved, Node: host})
 				delete(serversState, host)
+				delete(serversStateOld, host)
+				ok = false
+			}
+			serversLock.Unlock()
+			if !ok {
+				continue
+			}
+			// Try to get curent config version. Request is sent without lock.
+			vr, err := getServerConfVersion(nodeAddr)
+			serversLock.Lock()
+			if state, ok = serversState[host]; !ok {
+				serversLock.Unlock()
 				continue
 			}
-			// Try to get curent config version.
-			vr, err := getServerConfVersion(host)
-			serversState[host].CurentConfVersion = vr
-			serversState[host].LastErr = err
+			updatePolledVersion(serversState[host], vr, err)
 
 			// If CurentConfVersion or ReceivedConfVersion changed from last check (only for logs)
 			if stateOld, ok := serversStateOld[host]; ok {
 				if serversState[host].CurentConfVersion != stateOld.CurentConfVersion {
 					log.Printf("Node: %s. Config version changed: %d -> %d", host, stateOld.CurentConfVersion, serversState[host].CurentConfVersion)
+					publishEvent(controllerEvent{Type: eventLoadedVersion, Node: host, Version: serversState[host].CurentConfVersion, OldVersion: stateOld.CurentConfVersion})
 				}
 				if serversState[host].ReceivedConfVersion != stateOld.ReceivedConfVersion {
 					log.Printf("Node: %s. Received config version changed: %d -> %d", host, stateOld.ReceivedConfVersion, serversState[host].ReceivedConfVersion)
+					publishEvent(controllerEvent{Type: eventReceivedVersion, Node: host, Version: serversState[host].ReceivedConfVersion, OldVersion: stateOld.ReceivedConfVersion})
 				}
 			}
-			serversStateOld[host] = &ServerInfo{0, 0, state.CurentConfVersion, state.ReceivedConfVersion, nil}
+			serversStateOld[host] = &ServerInfo{CurentConfVersion: state.CurentConfVersion, ReceivedConfVersion: state.ReceivedConfVersion}
+			serversLock.Unlock()
 		}
 	}
 }
@@ -157,6 +217,8 @@ func serverListProcessing() {
 // Return readable info about all registered lb nodes.
 func getServersStatus(ver int) string {
 	var result string
+	serversLock.RLock()
+	defer serversLock.RUnlock()
 	for host, state := range serversState {
 		received := "no"
 		updated := "no"
@@ -166,13 +228,15 @@ func getServersStatus(ver int) string {
 		if state.CurentConfVersion >= ver {
 			updated = "yes"
 		}
-		result += fmt.Sprintf("Node: %s; received: %s; updated: %s\n", host, received, updated)
+		result += fmt.Sprintf("Node: %s; group: %s; target: %d; received: %s; updated: %s\n", host, state.Group, nodeTargetVersion(host), received, updated)
 	}
 	return result
 }
 
 // Return fool info about all registered lb nodes.
 func getServersStatusFull() string {
+	serversLock.RLock()
+	defer serversLock.RUnlock()
 	if len(serversState) == 0 {
 		return fmt.Sprintf("No registered nodes.")
 	}
@@ -181,26 +245,49 @@ func getServersStatusFull() string {
 		seenSecAgo := time.Now().Unix() - state.LastSeenTime
 		receivedSecAgo := time.Now().Unix() - state.LastConfReceivedTime
 		result += fmt.Sprintf("Node: %s\n", host)
+		result += fmt.Sprintf(" group: %s\n", state.Group)
 		result += fmt.Sprintf(" last seen (seconds ago): %d\n config received (seconds ago): %d\n", seenSecAgo, receivedSecAgo)
-		result += fmt.Sprintf(" curent config version: %d\n last received config version: %d\n\n", state.CurentConfVersion, state.ReceivedConfVersion)
+		result += fmt.Sprintf(" target config version: %d\n", nodeTargetVersion(host))
+		result += fmt.Sprintf(" curent config version: %d\n last received config version: %d\n", state.CurentConfVersion, state.ReceivedConfVersion)
+		if state.LastReportTime > 0 {
+			result += fmt.Sprintf(" last report (seconds ago): %d\n last reload (seconds ago): %d\n", time.Now().Unix()-state.LastReportTime, time.Now().Unix()-state.LastReloadTime)
+			result += fmt.Sprintf(" config hash: %s\n config test ok: %t\n", state.ConfHash, state.ConfTestOk)
+		}
+		if state.LastErr != nil {
+			result += fmt.Sprintf(" last error: %s\n", state.LastErr.Error())
+		}
+		result += "\n"
 	}
 	return result
 }
 
 // Endpoint /status
 // Return all info about registered nodes.
-// TODO: options to change format: plain, json, prom ...
+// Format (plain, json, prom) is set by 'format' param or Accept header.
+// Request example: http://controller-host:8081/status?format=json
 func srvStatusHandler(w http.ResponseWriter, r *http.Request) {
 	v, err := getConsulConfVersion()
 	if err != nil {
 		http.Error(w, "Error. Can't get config version. See controller logs", 403)
 		return
 	}
+	switch statusFormat(r) {
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(statusResponse{v, getRolloutStatusData(), getNodesStatus()})
+		return
+	case "prom":
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write([]byte(getServersStatusProm(v)))
+		return
+	}
 	w.Write([]byte(fmt.Sprintf("Consul config version: %d\n", v)))
+	w.Write([]byte(getRolloutStatus()))
 	w.Write([]byte(getServersStatusFull()))
 }
 
 // Wait for all registered lb nodes are receive and update configs to version 'ver int' or hight.
+// Nodes not allowed to take version yet (see rollout) are skipped.
 // Or return after timeout.
 func waitForReload(timeout int64, ver int) {
 	// Ticker for pause.
@@ -211,15 +298,19 @@ func waitForReload(timeout int64, ver int) {
 		select {
 		case <-tm:
 			return
+		case <-shuttingDown:
+			return
 		// Wait for tick.
 		case <-tick:
 			var counter int = 0
-			for _, state := range serversState {
-				if state.CurentConfVersion >= ver {
+			serversLock.RLock()
+			for host, state := range serversState {
+				if state.CurentConfVersion >= ver || nodeTargetVersion(host) < ver {
 					continue
 				}
 				counter++
 			}
+			serversLock.RUnlock()
 			if counter == 0 {
 				// All servers are received configs and loaded it.
 				return
@@ -228,16 +319,52 @@ func waitForReload(timeout int64, ver int) {
 	}
 }
 
-// Set http handlers and start http listener.
-func startListen() {
+// Set http handlers and start http listener in background.
+func startListen() *http.Server {
 	router := mux.NewRouter()
-	router.HandleFunc("/getconf", sendConfHandler).Methods("GET")
-	router.HandleFunc("/update", updateConfHandler).Methods("GET")
-	router.HandleFunc("/reg", nginxRegisterHandler).Methods("GET")
-	router.HandleFunc("/status", srvStatusHandler).Methods("GET")
+	router.HandleFunc("/getconf", requireRole(roleNode, sendConfHandler)).Methods("GET", "HEAD")
+	router.HandleFunc("/getconf/manifest", requireRole(roleNode, sendManifestHandler)).Methods("GET")
+	router.HandleFunc("/update", requireRole(roleOperator, updateConfHandler)).Methods("GET")
+	router.HandleFunc("/updates", requireRole(roleOperator, createUpdateJobHandler)).Methods("POST")
+	router.HandleFunc("/updates/{id}", requireRole(roleViewer, getUpdateJobHandler)).Methods("GET")
+	router.HandleFunc("/reg", requireRole(roleNode, nginxRegisterHandler)).Methods("GET")
+	router.HandleFunc("/status", requireRole(roleViewer, srvStatusHandler)).Methods("GET")
+	router.HandleFunc("/target", requireRole(roleNode, targetVersionHandler)).Methods("GET")
+	router.HandleFunc("/report", requireRole(roleNode, nodeReportHandler)).Methods("POST")
+	router.HandleFunc("/watch", requireRole(roleNode, watchHandler)).Methods("GET")
+	router.HandleFunc("/events", requireRole(roleViewer, eventsHandler)).Methods("GET")
+	router.HandleFunc("/events/ws", requireRole(roleViewer, eventsWsHandler)).Methods("GET")
+	router.HandleFunc("/rollback", requireRole(roleOperator, rollbackHandler)).Methods("POST")
+	router.HandleFunc("/versions", requireRole(roleViewer, versionsHandler)).Methods("GET")
+	router.HandleFunc("/versions/{version:[0-9]+}", requireRole(roleViewer, versionHandler)).Methods("GET")
+	router.HandleFunc("/versions/{from:[0-9]+}/diff/{to:[0-9]+}", requireRole(roleOperator, versionsDiffHandler)).Methods("GET")
+	router.HandleFunc("/versions/{version:[0-9]+}/pin", requireRole(roleOperator, pinVersionHandler)).Methods("PUT", "DELETE")
+	router.HandleFunc("/gc", requireRole(roleViewer, gcPlanHandler)).Methods("GET")
+	router.HandleFunc("/gc", requireRole(roleOperator, gcRunHandler)).Methods("POST")
+	router.HandleFunc("/audit", requireRole(roleViewer, auditQueryHandler)).Methods("GET")
+	router.HandleFunc("/metrics", requireRole(roleViewer, promhttp.Handler().ServeHTTP)).Methods("GET")
 	listenUrl := fmt.Sprintf("0.0.0.0:%s", *listenPort)
-	log.Printf("Runing listener on %s", listenUrl)
-	log.Fatal(http.ListenAndServe(listenUrl, router))
+	server := &http.Server{Addr: listenUrl, Handler: router}
+	if !tlsEnabled() {
+		log.Printf("Runing listener on %s", listenUrl)
+		go serve(server.ListenAndServe)
+		return server
+	}
+	tlsConfig, err := serverTlsConfig()
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	server.TLSConfig = tlsConfig
+	log.Printf("Runing TLS listener on %s", listenUrl)
+	go serve(func() error { return server.ListenAndServeTLS("", "") })
+	return server
+}
+
+// Run listener, listener errors are fatal (except shutdown).
+func serve(listen func() error) {
+	if err := listen(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
 }
 
 // Helper for args parse.
@@ -248,42 +375,52 @@ func getEnv(key string, defaultVal string) string {
 	return defaultVal
 }
 
-// Query to update configuration on all lb nodes.
-// 1) Generate new config pack from consul metadata.
-// 2) Update consul config version to notify all lb nodes that they need to update configs.
-func updateConfHandler(w http.ResponseWriter, r *http.Request) {
+// Helper for int args parse.
+func getEnvInt64(key string, defaultVal int64) int64 {
+	if envVal, ok := os.LookupEnv(key); ok {
+		if val, err := strconv.ParseInt(envVal, 10, 64); err == nil {
+			return val
+		}
+		log.Printf("Env %s is not a number, using default: %d", key, defaultVal)
+	}
+	return defaultVal
+}
 
-	version, err := incrConsulConfVersion()
-	w.Write([]byte(fmt.Sprintf("Incr conf version in consul: ok. New version: %d\n", version)))
-	if err != nil {
-		// Error with consul.
-		http.Error(w, err.Error(), 403)
-		return
+// Helper for float args parse.
+func getEnvFloat64(key string, defaultVal float64) float64 {
+	if envVal, ok := os.LookupEnv(key); ok {
+		if val, err := strconv.ParseFloat(envVal, 64); err == nil {
+			return val
+		}
+		log.Printf("Env %s is not a number, using default: %g", key, defaultVal)
 	}
-	projectsMetadataJson, err := getConsulKvJson("clients")
-	projectsMetadata := parseConsulProjectsData(projectsMetadataJson)
-	err = genConfig(projectsMetadata)
+	return defaultVal
+}
 
-	if err != nil {
-		http.Error(w, err.Error(), 403)
+// Query to update configuration on all lb nodes.
+// Runs update job (see POST /updates) and waits for its result.
+func updateConfHandler(w http.ResponseWriter, r *http.Request) {
+	sourceIp, _, _ := net.SplitHostPort(r.RemoteAddr)
+	job, started := startUpdateJob("manual", requestIdentity(r), sourceIp)
+	if !started {
+		log.Printf("Update job %s is running, waiting for it.", job.Id)
+	}
+	select {
+	case <-job.done:
+	case <-r.Context().Done():
 		return
 	}
-	// Write respond part to send buffer.
-	w.Write([]byte("Create config from template: ok\n"))
-	err = pkgConfigs(version)
-	if err != nil {
-		// Error with pkg configs.
-		http.Error(w, err.Error(), 403)
+	if job.Status == jobFailed {
+		http.Error(w, job.Error, 403)
 		return
 	}
-	// Write respond part to send buffer.
-	w.Write([]byte(fmt.Sprintf("Create configs pkg: ok\n")))
-
-	// TODO: configure wait time.
-	// Wait for all registered lb nodes receive configs and reload nginx. (But no longer than 3 minutes)
-	waitForReload(30, version)
-	// Write all registered nodes status.
-	w.Write([]byte(getServersStatus(version)))
+	w.Write([]byte(fmt.Sprintf("Update job: %s. New version: %d\n", job.Id, job.Version)))
+	for _, stage := range job.Stages {
+		w.Write([]byte(fmt.Sprintf("Stage %s: %s (%d ms)\n", stage.Name, stage.Status, stage.Duration)))
+	}
+	// Write rollout progress and all registered nodes status.
+	w.Write([]byte(getRolloutStatus()))
+	w.Write([]byte(getServersStatus(job.Version)))
 }
 
 // Send GET request to nginx lb "version url" /config_version to get curent config version loaded by nginx
@@ -315,24 +452,46 @@ func getServerConfVersion(hostname string) (version int, err error) {
 }
 
 // Endpoint for nginx lb registration. Client ip were added to list (check version, waiting for update)
+// Optional params: group - node group name, labels - node labels for group selectors.
+// Request example: http://controller-host:8081/reg?group=public&labels=pool=public,region=eu
 func nginxRegisterHandler(w http.ResponseWriter, r *http.Request) {
-	// get nginx lb ip (client ip)
-	serverIP, _, _ := net.SplitHostPort(r.RemoteAddr)
-	vr, err := getServerConfVersion(serverIP)
+	// get nginx lb identity and ip (client ip)
+	nodeID, nodeAddr := nodeIdentity(r)
+	vr, err := getServerConfVersion(nodeAddr)
+	labels := parseNodeLabels(r.URL.Query().Get("labels"))
+	group := matchNodeGroup(r.URL.Query().Get("group"), labels)
+	serversLock.Lock()
+	defer serversLock.Unlock()
 	// If ip is not in the list - add
-	if _, ok := serversState[serverIP]; !ok {
-		log.Printf("Node %s added to nodes list.", serverIP)
-		serversState[serverIP] = &ServerInfo{time.Now().Unix(), 0, vr, 0, err}
+	if _, ok := serversState[nodeID]; !ok {
+		log.Printf("Node %s added to nodes list, group: %s.", nodeID, group)
+		publishEvent(controllerEvent{Type: eventNodeAdded, Node: nodeID, Data: group})
+		serversState[nodeID] = &ServerInfo{LastSeenTime: time.Now().Unix(), CurentConfVersion: vr, LastErr: err, Group: group, Labels: labels, Addr: nodeAddr}
 		return
 	}
 	// Update server info
-	serversState[serverIP].LastSeenTime = time.Now().Unix()
-	serversState[serverIP].CurentConfVersion = vr
-	serversState[serverIP].LastErr = err
+	if serversState[nodeID].Group != group {
+		log.Printf("Node %s group changed: %s -> %s", nodeID, serversState[nodeID].Group, group)
+	}
+	serversState[nodeID].LastSeenTime = time.Now().Unix()
+	updatePolledVersion(serversState[nodeID], vr, err)
+	serversState[nodeID].Group = group
+	serversState[nodeID].Labels = labels
+	serversState[nodeID].Addr = nodeAddr
+}
+
+// Endpoint to get config version node is allowed to load now (see rollout).
+// Request example: http://controller-host:8081/target
+func targetVersionHandler(w http.ResponseWriter, r *http.Request) {
+	nodeID, _ := nodeIdentity(r)
+	w.Write([]byte(strconv.Itoa(nodeTargetVersion(nodeID))))
 }
 
 // Endpoint to get configs pack (gzip of all nginx conf.d directory)
-// Request example: http://controller-host:8081/getconf?ver=12345
+// With 'from' and 'from_group' params delta pack from node's current version is sent if possible
+// (X-Delta-From header is set), otherwise full pack. Delta is sent only if node's current version
+// is of the same group, delta of other group base doesn't give the right configs.
+// Request example: http://controller-host:8081/getconf?ver=12345&from=12340&from_group=public
 func sendConfHandler(w http.ResponseWriter, r *http.Request) {
 	// get requested version number
 	var version string = r.URL.Query().Get("ver")
@@ -343,66 +502,309 @@ func sendConfHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	iVersion, err := strconv.Atoi(version)
-	if err != nil {
-		log.Println("Url Param 'key' is not a number")
+	if err != nil || iVersion <= 0 {
+		log.Println("Url Param 'ver' is not a version number")
 		http.Error(w, "Missing version number.", 404)
 		return
 	}
+	// Get server (receiver) identity and ip
+	nodeID, nodeAddr := nodeIdentity(r)
+	group := nodePackageGroup(nodeID)
+	// Bad versions are never served.
+	if isVersionBad(iVersion) {
+		log.Printf("Node %s requested bad version %s.", nodeID, version)
+		http.Error(w, "Version is marked as bad.", 410)
+		return
+	}
+	// Version is not allowed for this node yet (rollout in progress).
+	if iVersion > nodeTargetVersion(nodeID) {
+		log.Printf("Node %s requested version %s, not allowed yet.", nodeID, version)
+		http.Error(w, "Version is not available for this node yet. Try again later.", 404)
+		return
+	}
+	pkgName := packageFileName(group, iVersion, packageFormat(r))
+	if !packageExists(pkgName) {
+		// Packages made before zstd support are gzip only.
+		pkgName = packageFileName(group, iVersion, formatGzip)
+	}
+	if from, err := strconv.Atoi(r.URL.Query().Get("from")); err == nil {
+		fromGroup := r.URL.Query().Get("from_group")
+		deltaName, err := "", fmt.Errorf("base version is of group '%s', node group is '%s'", fromGroup, group)
+		if fromGroup == group {
+			deltaName, err = deltaPackage(group, from, iVersion)
+		}
+		if err == nil {
+			pkgName = deltaName
+			w.Header().Set(deltaFromHeader, strconv.Itoa(from))
+		} else {
+			log.Printf("No delta from version %d for node %s, sending full pack: %s", from, nodeID, err.Error())
+		}
+	}
+	// Packages are served with detached signatures if signing is enabled, unsigned packages are refused.
+	// Signature is not looked up otherwise, there is none and miss costs store request.
+	if signingEnabled() {
+		signature, err := readSignature(pkgName)
+		if err != nil {
+			log.Printf("Package %s is not signed, refused: %s", pkgName, err.Error())
+			http.Error(w, "Package is not signed.", 500)
+			return
+		}
+		w.Header().Set(signatureHeader, signature)
+	}
+	// Store redirect: node downloads package by presigned url, signature and delta headers are sent with redirect.
+	if *storeRedirect && r.Method == http.MethodGet {
+		pkgUrl, err := packageStore.DownloadUrl(pkgName, time.Duration(*storeUrlExpiry)*time.Second)
+		if err != nil {
+			log.Printf("Can't get download url of %s: %s", pkgName, err.Error())
+		} else if pkgUrl != "" {
+			// Node may never download by redirect, download is counted when node reports the version.
+			log.Printf("Node %s redirected to store for version %d", nodeID, iVersion)
+			http.Redirect(w, r, pkgUrl, http.StatusFound)
+			return
+		}
+	}
 	// Check if config pack exists
-	ConfigsPkgFile, err := os.Open(*configsPkgsDir + "/" + version + ".tar.gz")
-	// Close file after return (see defer)
-	defer ConfigsPkgFile.Close() //Close after function return
+	err = ensureLocal(pkgName)
 	if err != nil {
 		//File not found, send 404
 		http.Error(w, "File not found. Try again later.", 404)
 		return
 	}
+	pkgFile, err := os.Open(pkgName)
+	if err != nil {
+		//File not found, send 404
+		http.Error(w, "File not found. Try again later.", 404)
+		return
+	}
+	defer pkgFile.Close()
+	pkgStat, err := pkgFile.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	etag, err := packageEtag(pkgName, pkgStat)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
 
-	//Get the Content-Type of the file
-	//Create a buffer to store the header of the file in
-	FileHeader := make([]byte, 512)
-	//Copy the headers into the FileHeader buffer
-	ConfigsPkgFile.Read(FileHeader)
-	//Get content type of file
-	FileContentType := http.DetectContentType(FileHeader)
-
-	//Get the file size
-	FileStat, _ := ConfigsPkgFile.Stat()               //Get info from file
-	FileSize := strconv.FormatInt(FileStat.Size(), 10) //Get file size as a string
-
-	//Send the headers
-	w.Header().Set("Content-Disposition", "attachment; filename="+"go.sum")
-	w.Header().Set("Content-Type", FileContentType)
-	w.Header().Set("Content-Length", FileSize)
-
-	//Send the file
-	//We read 512 bytes from the file already, so we reset the offset back to 0
-	ConfigsPkgFile.Seek(0, 0)
-	io.Copy(w, ConfigsPkgFile) //'Copy' the file to the client
-	// Get server (receiver) ip
-	serverIP, _, _ := net.SplitHostPort(r.RemoteAddr)
-	log.Printf("Request from host: %s, version: %s", serverIP, version)
+	// ServeContent handles HEAD, Range and If-None-Match/If-Modified-Since (304).
+	w.Header().Set("Content-Disposition", "attachment; filename="+filepath.Base(pkgName))
+	w.Header().Set("Content-Type", packageContentType(pkgName))
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Vary", "Accept")
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	http.ServeContent(sw, r, "", pkgStat.ModTime(), pkgFile)
+	// Node state is updated only when package content is sent.
+	if r.Method != http.MethodGet || (sw.status != http.StatusOK && sw.status != http.StatusPartialContent) {
+		return
+	}
+	registerPackageReceived(nodeID, nodeAddr, group, iVersion)
+}
+
+// Count package download and update node state.
+func registerPackageReceived(nodeID, nodeAddr, group string, iVersion int) {
+	packageDownloadsTotal.WithLabelValues(strconv.Itoa(iVersion)).Inc()
+	log.Printf("Request from host: %s, group: %s, version: %d", nodeID, group, iVersion)
 	// Update server info
-	if _, ok := serversState[serverIP]; !ok {
+	serversLock.Lock()
+	defer serversLock.Unlock()
+	if _, ok := serversState[nodeID]; !ok {
 		// Add if not exists
-		log.Printf("Node %s not in a nodes list, adding.", serverIP)
-		serversState[serverIP] = &ServerInfo{time.Now().Unix(), time.Now().Unix(), 0, iVersion, nil}
+		log.Printf("Node %s not in a nodes list, adding.", nodeID)
+		publishEvent(controllerEvent{Type: eventNodeAdded, Node: nodeID, Data: group})
+		serversState[nodeID] = &ServerInfo{LastSeenTime: time.Now().Unix(), LastConfReceivedTime: time.Now().Unix(), ReceivedConfVersion: iVersion, Group: group, Addr: nodeAddr}
 		return
 	}
 	// Update info
-	serversState[serverIP].LastSeenTime = time.Now().Unix()
-	serversState[serverIP].LastConfReceivedTime = time.Now().Unix()
-	serversState[serverIP].ReceivedConfVersion = iVersion
+	serversState[nodeID].LastSeenTime = time.Now().Unix()
+	serversState[nodeID].LastConfReceivedTime = time.Now().Unix()
+	serversState[nodeID].ReceivedConfVersion = iVersion
+}
+
+// Response writer which remembers response status.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	sw.status = status
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+// Package content type by file name.
+func packageContentType(pkgName string) string {
+	if strings.HasSuffix(pkgName, packageExts[formatZstd]) {
+		return packageContentTypes[formatZstd]
+	}
+	return packageContentTypes[formatGzip]
 }
 
-// Create gzip of configs directory (configs pkg).
-func pkgConfigs(version int) (Error error) {
-	pkgName := fmt.Sprintf("%s/%d.tar.gz", *configsPkgsDir, version)
-	err := compress(*configsDir, pkgName)
+// Package ETags cache: file name - ETag of file size and time.
+type packageEtagEntry struct {
+	size    int64
+	modTime time.Time
+	etag    string
+}
+
+var packageEtags = make(map[string]packageEtagEntry)
+var packageEtagsLock sync.Mutex
+
+// Cache size to check cached packages for deleted files.
+const packageEtagsMinSweepSize = 10000
+
+var packageEtagsSweepSize = packageEtagsMinSweepSize
+
+// ETag of package, sha256 of content. Packages are written once, so hash is cached by file size and time.
+func packageEtag(pkgName string, stat os.FileInfo) (string, error) {
+	packageEtagsLock.Lock()
+	entry, ok := packageEtags[pkgName]
+	packageEtagsLock.Unlock()
+	if ok && entry.size == stat.Size() && entry.modTime.Equal(stat.ModTime()) {
+		return entry.etag, nil
+	}
+	hash, err := fileHash(pkgName)
+	if err != nil {
+		return "", err
+	}
+	entry = packageEtagEntry{size: stat.Size(), modTime: stat.ModTime(), etag: `"` + hash + `"`}
+	packageEtagsLock.Lock()
+	// Forget packages deleted not by GC (GC removes entries of deleted files).
+	if len(packageEtags) >= packageEtagsSweepSize {
+		for name := range packageEtags {
+			if _, err := os.Stat(name); os.IsNotExist(err) {
+				delete(packageEtags, name)
+			}
+		}
+		// Many existing packages (long retention) are not checked on every new package.
+		packageEtagsSweepSize = 2 * len(packageEtags)
+		if packageEtagsSweepSize < packageEtagsMinSweepSize {
+			packageEtagsSweepSize = packageEtagsMinSweepSize
+		}
+	}
+	packageEtags[pkgName] = entry
+	packageEtagsLock.Unlock()
+	return entry.etag, nil
+}
+
+// Remove cached ETag of deleted package.
+func forgetPackageEtag(pkgName string) {
+	packageEtagsLock.Lock()
+	delete(packageEtags, pkgName)
+	packageEtagsLock.Unlock()
+}
+
+// zstd packages missing in store of versions with gzip package (made before zstd support).
+// Entries are removed with deleted packages.
+var missingPackages = make(map[string]bool)
+var missingPackagesLock sync.Mutex
+
+// Check that package is stored, it's not downloaded (node may be redirected to store).
+// Missing zstd package of version with gzip package is remembered, so store is not
+// requested for it on every /getconf. Other misses are not remembered, node could
+// request any not existing version.
+func packageExists(pkgName string) bool {
+	missingPackagesLock.Lock()
+	missing := missingPackages[pkgName]
+	missingPackagesLock.Unlock()
+	if missing {
+		return false
+	}
+	err := isStored(pkgName)
+	if os.IsNotExist(err) && strings.HasSuffix(pkgName, packageExts[formatZstd]) &&
+		isStored(strings.TrimSuffix(pkgName, packageExts[formatZstd])+packageExts[formatGzip]) == nil {
+		missingPackagesLock.Lock()
+		missingPackages[pkgName] = true
+		missingPackagesLock.Unlock()
+	}
+	return err == nil
+}
+
+// Forget missing package, it's written now.
+func forgetMissingPackage(pkgName string) {
+	missingPackagesLock.Lock()
+	delete(missingPackages, pkgName)
+	missingPackagesLock.Unlock()
+}
+
+// Package format requested by 'format' param or Accept header, gzip by default.
+func packageFormat(r *http.Request) string {
+	switch format := r.URL.Query().Get("format"); format {
+	case formatGzip, formatZstd:
+		return format
+	}
+	if strings.Contains(r.Header.Get("Accept"), packageContentTypes[formatZstd]) {
+		return formatZstd
+	}
+	return formatGzip
+}
+
+// Group of node packages. Unregistered nodes receive default group package.
+func nodePackageGroup(nodeID string) string {
+	serversLock.RLock()
+	defer serversLock.RUnlock()
+	if state, ok := serversState[nodeID]; ok && state.Group != "" {
+		return state.Group
+	}
+	return *defaultGroup
+}
+
+// Create gzip of configs directory (configs pkg), one pkg per node group.
+// Package contains manifest with files checksums, manifest is also saved next to package.
+func pkgConfigs(version int, templates map[string]string) error {
+	defer observeStage(stagePackage, time.Now())
+	for _, group := range nodeGroupNames() {
+		if err := pkgGroupConfigs(group, version, groupDir(*configsDir, group), templates); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Make signed and stored packages and manifest of group version from src dir.
+func pkgGroupConfigs(group string, version int, src string, templates map[string]string) error {
+	groupPkgsDir := groupDir(*configsPkgsDir, group)
+	err := os.MkdirAll(groupPkgsDir, os.FileMode(0755))
 	if err != nil {
 		log.Println(err.Error())
 		return err
-	} 
-	log.Printf("Configs pack created: %s\n", pkgName)
+	}
+	manifest, err := buildManifest(version, group, src, templates)
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	manifestData, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(manifestFileName(group, version), manifestData, os.FileMode(0644))
+	if err == nil {
+		err = signFile(manifestFileName(group, version))
+	}
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	err = compress(src, fmt.Sprintf("%s/%d", groupPkgsDir, version), manifestData)
+	for _, format := range []string{formatGzip, formatZstd} {
+		if err == nil {
+			// Version number of failed job is used again.
+			forgetMissingPackage(packageFileName(group, version, format))
+			err = signFile(packageFileName(group, version, format))
+		}
+	}
+	// Upload to store after signing, so store never has unsigned packages.
+	if err == nil {
+		manifestName := manifestFileName(group, version)
+		gzipName, zstdName := packageFileName(group, version, formatGzip), packageFileName(group, version, formatZstd)
+		err = storeFiles(manifestName, signatureFile(manifestName), gzipName, signatureFile(gzipName), zstdName, signatureFile(zstdName))
+	}
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	log.Printf("Configs packs created: %s/%d.{tar.gz,tar.zst}\n", groupPkgsDir, version)
 	return nil
 }
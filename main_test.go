@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPackageEtagEviction(t *testing.T) {
+	dir := t.TempDir()
+	packageEtagsLock.Lock()
+	oldEtags, oldSweepSize := packageEtags, packageEtagsSweepSize
+	packageEtags, packageEtagsSweepSize = make(map[string]packageEtagEntry), 2
+	packageEtagsLock.Unlock()
+	t.Cleanup(func() {
+		packageEtagsLock.Lock()
+		packageEtags, packageEtagsSweepSize = oldEtags, oldSweepSize
+		packageEtagsLock.Unlock()
+	})
+	etag := func(name string) {
+		stat, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = packageEtag(name, stat); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cached := func(name string) bool {
+		packageEtagsLock.Lock()
+		defer packageEtagsLock.Unlock()
+		_, ok := packageEtags[name]
+		return ok
+	}
+	writeTestFiles(t, dir, map[string]string{"1.tar.gz": "1", "2.tar.gz": "2", "3.tar.gz": "3", "4.tar.gz": "4", "5.tar.gz": "5"})
+	names := make(map[int]string)
+	for i := 1; i <= 5; i++ {
+		names[i] = filepath.Join(dir, fmt.Sprintf("%d.tar.gz", i))
+	}
+	etag(names[1])
+	etag(names[2])
+	// Deleted by GC: entry is removed at once.
+	if err := deleteStoredFile(names[1]); err != nil {
+		t.Fatal(err)
+	}
+	if cached(names[1]) {
+		t.Fatal("ETag of deleted package is kept")
+	}
+	etag(names[3])
+	// Deleted not by GC: entry is removed on sweep, entries of existing packages are kept.
+	os.Remove(names[2])
+	etag(names[4])
+	if cached(names[2]) {
+		t.Fatal("ETag of missing package is not swept")
+	}
+	for _, i := range []int{3, 4} {
+		if !cached(names[i]) {
+			t.Fatalf("ETag of existing package %d is evicted", i)
+		}
+	}
+	etag(names[5])
+	if !cached(names[3]) || !cached(names[5]) {
+		t.Fatal("ETags of existing packages are evicted")
+	}
+}
+
+// Local store counting requests of missing files.
+type testCountingStore struct {
+	localPackageStore
+	requests map[string]int
+}
+
+func (s testCountingStore) Open(path string) (io.ReadCloser, error) {
+	s.requests[filepath.Base(path)]++
+	return s.localPackageStore.Open(path)
+}
+
+func (s testCountingStore) Stat(path string) (storeFileInfo, error) {
+	s.requests[filepath.Base(path)]++
+	return s.localPackageStore.Stat(path)
+}
+
+func TestPackageExistsCachesMissing(t *testing.T) {
+	testPkgsDir(t)
+	store := testCountingStore{requests: make(map[string]int)}
+	oldStore := packageStore
+	packageStore = store
+	t.Cleanup(func() { packageStore = oldStore })
+	writeTestFiles(t, groupDir(*configsPkgsDir, *defaultGroup), map[string]string{"1.tar.gz": "gzip only"})
+	missingPackagesLock.Lock()
+	oldMissing := missingPackages
+	missingPackages = make(map[string]bool)
+	missingPackagesLock.Unlock()
+	t.Cleanup(func() {
+		missingPackagesLock.Lock()
+		missingPackages = oldMissing
+		missingPackagesLock.Unlock()
+	})
+	zstdName := packageFileName(*defaultGroup, 1, formatZstd)
+	for i := 0; i < 3; i++ {
+		if packageExists(zstdName) {
+			t.Fatal("missing package exists")
+		}
+		if !packageExists(packageFileName(*defaultGroup, 1, formatGzip)) {
+			t.Fatal("local package doesn't exist")
+		}
+	}
+	if store.requests["1.tar.zst"] != 1 {
+		t.Fatalf("store is requested %d times for missing package", store.requests["1.tar.zst"])
+	}
+	// Versions without any package are not remembered, cache doesn't grow with requested versions.
+	for version := 2; version < 5; version++ {
+		packageExists(packageFileName(*defaultGroup, version, formatZstd))
+	}
+	missingPackagesLock.Lock()
+	cached := len(missingPackages)
+	missingPackagesLock.Unlock()
+	if cached != 1 {
+		t.Fatalf("%d missing packages are remembered", cached)
+	}
+	// Deleted version is forgotten.
+	if err := deleteStoredFile(packageFileName(*defaultGroup, 1, formatGzip)); err != nil {
+		t.Fatal(err)
+	}
+	missingPackagesLock.Lock()
+	cached = len(missingPackages)
+	missingPackagesLock.Unlock()
+	if cached != 0 {
+		t.Fatalf("missing package of deleted version is remembered")
+	}
+	writeTestFiles(t, groupDir(*configsPkgsDir, *defaultGroup), map[string]string{"1.tar.gz": "gzip only"})
+	if packageExists(zstdName) {
+		t.Fatal("missing package exists")
+	}
+	// Version is packaged again (version number of failed job).
+	if err := pkgGroupConfigs(*defaultGroup, 1, t.TempDir(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if !packageExists(zstdName) {
+		t.Fatal("written package is still missing")
+	}
+}
+
+func TestSendConfBadVersionNumber(t *testing.T) {
+	testPkgsDir(t)
+	store := testCountingStore{requests: make(map[string]int)}
+	oldStore := packageStore
+	packageStore = store
+	t.Cleanup(func() { packageStore = oldStore })
+	for _, version := range []string{"0", "-1", "x"} {
+		for _, handler := range []http.HandlerFunc{sendConfHandler, sendManifestHandler} {
+			w := httptest.NewRecorder()
+			handler(w, httptest.NewRequest("GET", "/getconf?ver="+version, nil))
+			if w.Code != 404 {
+				t.Fatalf("version %s: status %d", version, w.Code)
+			}
+		}
+	}
+	if len(store.requests) != 0 {
+		t.Fatalf("store is requested for bad version number: %v", store.requests)
+	}
+}
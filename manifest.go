@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Controller build, set on build: go build -ldflags "-X main.buildVersion=1.2.3"
+var buildVersion = "dev"
+
+// Manifest name inside package.
+const manifestName = "manifest.json"
+
+// File in package manifest.
+type manifestFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Mode   uint32 `json:"mode"`
+	Sha256 string `json:"sha256"`
+}
+
+// Package manifest: package content with checksums.
+type packageManifest struct {
+	Version        int               `json:"version"`
+	Group          string            `json:"group"`
+	Created        int64             `json:"created"`
+	Build          string            `json:"build"`
+	TemplateHashes map[string]string `json:"template_hashes"`
+	Files          []manifestFile    `json:"files"`
+}
+
+// Manifest file name, next to group package.
+func manifestFileName(group string, version int) string {
+	return fmt.Sprintf("%s/%d.manifest.json", groupDir(*configsPkgsDir, group), version)
+}
+
+// Build manifest of configs dir.
+func buildManifest(version int, group, dir string, templates map[string]string) (*packageManifest, error) {
+	files, err := manifestFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &packageManifest{
+		Version:        version,
+		Group:          group,
+		Created:        time.Now().Unix(),
+		Build:          buildVersion,
+		TemplateHashes: templates,
+		Files:          files,
+	}, nil
+}
+
+// Regular files of dir with checksums, sorted by path. Manifest itself is skipped.
+func manifestFiles(dir string) ([]manifestFile, error) {
+	files := []manifestFile{}
+	err := filepath.Walk(dir, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == manifestName {
+			return nil
+		}
+		hash, err := fileHash(file)
+		if err != nil {
+			return err
+		}
+		files = append(files, manifestFile{Path: rel, Size: fi.Size(), Mode: uint32(fi.Mode().Perm()), Sha256: hash})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files, nil
+}
+
+// Compare dir files with manifest, return list of differences (empty - dir matches).
+func manifestDrift(manifest *packageManifest, dir string) ([]string, error) {
+	actual, err := manifestFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	actualByPath := make(map[string]manifestFile)
+	for _, file := range actual {
+		actualByPath[file.Path] = file
+	}
+	var drift []string
+	for _, expected := range manifest.Files {
+		file, ok := actualByPath[expected.Path]
+		switch {
+		case !ok:
+			drift = append(drift, "missing: "+expected.Path)
+		case file.Size != expected.Size || file.Sha256 != expected.Sha256:
+			drift = append(drift, "changed: "+expected.Path)
+		case file.Mode != expected.Mode:
+			drift = append(drift, "mode changed: "+expected.Path)
+		}
+		delete(actualByPath, expected.Path)
+	}
+	for path := range actualByPath {
+		drift = append(drift, "unexpected: "+path)
+	}
+	sort.Strings(drift)
+	return drift, nil
+}
+
+// Endpoint to get package manifest without package.
+// Request example: http://controller-host:8081/getconf/manifest?ver=12345
+func sendManifestHandler(w http.ResponseWriter, r *http.Request) {
+	version, err := strconv.Atoi(r.URL.Query().Get("ver"))
+	if err != nil || version <= 0 {
+		http.Error(w, "Missing version number.", 404)
+		return
+	}
+	nodeID, _ := nodeIdentity(r)
+	if isVersionBad(version) {
+		http.Error(w, "Version is marked as bad.", 410)
+		return
+	}
+	if version > nodeTargetVersion(nodeID) {
+		http.Error(w, "Version is not available for this node yet. Try again later.", 404)
+		return
+	}
+	manifestPath := manifestFileName(nodePackageGroup(nodeID), version)
+	var data []byte
+	err = ensureLocal(manifestPath)
+	if err == nil {
+		data, err = ioutil.ReadFile(manifestPath)
+	}
+	if err != nil {
+		log.Printf("Manifest of version %d for node %s: %s", version, nodeID, err.Error())
+		http.Error(w, "Manifest not found.", 404)
+		return
+	}
+	if signingEnabled() {
+		signature, err := readSignature(manifestPath)
+		if err != nil {
+			log.Printf("Manifest %s is not signed, refused: %s", manifestPath, err.Error())
+			http.Error(w, "Manifest is not signed.", 500)
+			return
+		}
+		w.Header().Set(signatureHeader, signature)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// Parse manifest JSON.
+func parseManifest(data []byte) (*packageManifest, error) {
+	manifest := &packageManifest{}
+	err := json.Unmarshal(data, manifest)
+	if err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestBuildManifest(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFiles(t, dir, map[string]string{"b.conf": "bb", "sites/a.conf": "a", manifestName: "{}"})
+	manifest, err := buildManifest(3, "internal", dir, map[string]string{"site.tmpl": "hash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Version != 3 || manifest.Group != "internal" || manifest.TemplateHashes["site.tmpl"] != "hash" {
+		t.Fatalf("bad manifest header: %+v", manifest)
+	}
+	// Sorted by path, manifest itself is skipped.
+	var paths []string
+	for _, file := range manifest.Files {
+		paths = append(paths, file.Path)
+	}
+	if !reflect.DeepEqual(paths, []string{"b.conf", "sites/a.conf"}) {
+		t.Fatalf("files %v", paths)
+	}
+	if file := manifest.Files[0]; file.Size != 2 || file.Mode != 0644 || len(file.Sha256) != 64 {
+		t.Fatalf("bad file entry: %+v", file)
+	}
+}
+
+func TestManifestDrift(t *testing.T) {
+	files := map[string]string{"a.conf": "a", "sites/b.conf": "b"}
+	tests := []struct {
+		name   string
+		change func(dir string) error
+		drift  []string
+	}{
+		{"no changes", func(dir string) error { return nil }, nil},
+		{"changed", func(dir string) error {
+			return ioutil.WriteFile(filepath.Join(dir, "a.conf"), []byte("x"), 0644)
+		}, []string{"changed: a.conf"}},
+		{"changed same size", func(dir string) error {
+			return ioutil.WriteFile(filepath.Join(dir, "sites/b.conf"), []byte("c"), 0644)
+		}, []string{"changed: sites/b.conf"}},
+		{"missing", func(dir string) error {
+			return os.Remove(filepath.Join(dir, "sites/b.conf"))
+		}, []string{"missing: sites/b.conf"}},
+		{"unexpected", func(dir string) error {
+			return ioutil.WriteFile(filepath.Join(dir, "sites/c.conf"), []byte("c"), 0644)
+		}, []string{"unexpected: sites/c.conf"}},
+		{"mode changed", func(dir string) error {
+			return os.Chmod(filepath.Join(dir, "a.conf"), 0600)
+		}, []string{"mode changed: a.conf"}},
+		{"manifest is not unexpected", func(dir string) error {
+			return ioutil.WriteFile(filepath.Join(dir, manifestName), []byte("{}"), 0644)
+		}, nil},
+		{"several", func(dir string) error {
+			os.Remove(filepath.Join(dir, "a.conf"))
+			return ioutil.WriteFile(filepath.Join(dir, "z.conf"), []byte("z"), 0644)
+		}, []string{"missing: a.conf", "unexpected: z.conf"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeTestFiles(t, dir, files)
+			manifest, err := buildManifest(1, *defaultGroup, dir, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = test.change(dir); err != nil {
+				t.Fatal(err)
+			}
+			drift, err := manifestDrift(manifest, dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(drift, test.drift) {
+				t.Fatalf("drift %q, want %q", drift, test.drift)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Pipeline stages.
+const (
+	stageConsulFetch = "consul_fetch"
+	stageParse       = "parse"
+	stageRender      = "render"
+	stagePackage     = "package"
+)
+
+var stageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "lb_controller_stage_duration_seconds",
+	Help:    "Duration of config pipeline stages.",
+	Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+}, []string{"stage"})
+
+var updatesTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "lb_controller_updates_total",
+	Help: "Config updates started.",
+})
+
+var updateFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lb_controller_update_failures_total",
+	Help: "Config updates failed, by stage.",
+}, []string{"stage"})
+
+var packageDownloadsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lb_controller_package_downloads_total",
+	Help: "Config packages sent to nodes, by version.",
+}, []string{"version"})
+
+var consulErrorsTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "lb_controller_consul_errors_total",
+	Help: "Failed consul requests.",
+})
+
+var projectsCount = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "lb_controller_projects",
+	Help: "Projects count in last parsed metadata.",
+})
+
+var domainsCount = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "lb_controller_domains",
+	Help: "Domains count in last parsed metadata.",
+})
+
+var _ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+	Name: "lb_controller_registered_nodes",
+	Help: "Registered lb nodes count.",
+}, func() float64 {
+	serversLock.RLock()
+	defer serversLock.RUnlock()
+	return float64(len(serversState))
+})
+
+var convergenceSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "lb_controller_convergence_seconds",
+	Help:    "Time from version publish to all nodes loaded it, observed once per version.",
+	Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+})
+
+var gcRunsTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "lb_controller_gc_runs_total",
+	Help: "Old versions cleanups.",
+})
+
+var gcDeletedVersionsTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "lb_controller_gc_deleted_versions_total",
+	Help: "Versions deleted by retention policy.",
+})
+
+var gcDeletedBytesTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "lb_controller_gc_deleted_bytes_total",
+	Help: "Bytes of versions files deleted by retention policy.",
+})
+
+var gcKeptVersions = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "lb_controller_gc_kept_versions",
+	Help: "Versions kept after last cleanup.",
+})
+
+var gcKeptBytes = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "lb_controller_gc_kept_bytes",
+	Help: "Bytes of versions files kept after last cleanup.",
+})
+
+var gcLastRunTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "lb_controller_gc_last_run_timestamp_seconds",
+	Help: "Time of last old versions cleanup.",
+})
+
+// Observe stage duration since start.
+func observeStage(stage string, start time.Time) {
+	stageDuration.WithLabelValues(stage).Observe(time.Since(start).Seconds())
+}
+
+// Set projects and domains gauges.
+func setMetadataMetrics(projects projectsMetadataType) {
+	domains := 0
+	for _, project := range projects {
+		domains += len(project.Domains)
+	}
+	projectsCount.Set(float64(len(projects)))
+	domainsCount.Set(float64(domains))
+}
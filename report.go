@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Node report about config apply result.
+// Version - version node tried to apply, TestOk - 'nginx -t' result, ReloadTime - unix time of nginx reload.
+type nodeReport struct {
+	Version    int    `json:"version"`
+	ConfHash   string `json:"conf_hash"`
+	TestOk     bool   `json:"test_ok"`
+	TestOutput string `json:"test_output"`
+	ReloadTime int64  `json:"reload_time"`
+}
+
+// Endpoint for nodes to report config apply result.
+// Request example: curl -X POST -d '{"version": 12, "conf_hash": "...", "test_ok": true}' http://controller-host:8081/report
+func nodeReportHandler(w http.ResponseWriter, r *http.Request) {
+	nodeID, nodeAddr := nodeIdentity(r)
+	var report nodeReport
+	err := json.NewDecoder(r.Body).Decode(&report)
+	if err != nil {
+		log.Printf("Bad report from node %s: %s", nodeID, err.Error())
+		http.Error(w, "Bad report format.", 400)
+		return
+	}
+	serversLock.Lock()
+	defer serversLock.Unlock()
+	state, ok := serversState[nodeID]
+	if !ok {
+		log.Printf("Node %s not in a nodes list, adding.", nodeID)
+		publishEvent(controllerEvent{Type: eventNodeAdded, Node: nodeID, Data: *defaultGroup})
+		state = &ServerInfo{Group: *defaultGroup, Addr: nodeAddr}
+		serversState[nodeID] = state
+	}
+	state.LastSeenTime = time.Now().Unix()
+	state.LastReportTime = time.Now().Unix()
+	state.ConfHash = report.ConfHash
+	state.ConfTestOk = report.TestOk
+	state.ConfTestOutput = report.TestOutput
+	if report.ReloadTime > 0 {
+		state.LastReloadTime = report.ReloadTime
+	}
+	// Package downloaded from store by redirect, controller didn't see the download.
+	if report.Version > state.ReceivedConfVersion {
+		packageDownloadsTotal.WithLabelValues(strconv.Itoa(report.Version)).Inc()
+		state.LastConfReceivedTime = time.Now().Unix()
+		state.ReceivedConfVersion = report.Version
+	}
+	if !report.TestOk {
+		state.LastErr = fmt.Errorf("config test of version %d failed: %s", report.Version, report.TestOutput)
+		log.Printf("Node %s failed to load version %d: %s", nodeID, report.Version, report.TestOutput)
+		return
+	}
+	state.CurentConfVersion = report.Version
+	state.LastErr = nil
+}
+
+// Update node info with /config_version poll result. Successful poll doesn't clear reported load error.
+func updatePolledVersion(state *ServerInfo, vr int, err error) {
+	state.CurentConfVersion = vr
+	if err != nil || state.LastReportTime == 0 || state.ConfTestOk {
+		state.LastErr = err
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// Store with presigned urls, files are kept locally.
+type testRedirectStore struct {
+	localPackageStore
+}
+
+func (testRedirectStore) DownloadUrl(path string, expiry time.Duration) (string, error) {
+	return "https://store.example.com/" + filepath.Base(path), nil
+}
+
+func TestStoreRedirectDownloadCounted(t *testing.T) {
+	testPkgsDir(t)
+	testPublishVersion(t, 2, map[string]string{"a.conf": "a"})
+	oldRedirect, oldStore := *storeRedirect, packageStore
+	*storeRedirect, packageStore = true, testRedirectStore{}
+	rolloutLock.Lock()
+	oldRollout := rollout
+	rollout = &rolloutState{Version: 2, Status: rolloutDone}
+	rolloutLock.Unlock()
+	t.Cleanup(func() {
+		*storeRedirect, packageStore = oldRedirect, oldStore
+		rolloutLock.Lock()
+		rollout = oldRollout
+		rolloutLock.Unlock()
+		serversLock.Lock()
+		delete(serversState, "192.0.2.2")
+		serversLock.Unlock()
+	})
+	downloads := func() float64 { return testutil.ToFloat64(packageDownloadsTotal.WithLabelValues("2")) }
+	before := downloads()
+
+	r := httptest.NewRequest("GET", "/getconf?ver=2", nil)
+	r.RemoteAddr = "192.0.2.2:1234"
+	w := httptest.NewRecorder()
+	sendConfHandler(w, r)
+	if w.Code != 302 || !strings.HasPrefix(w.Header().Get("Location"), "https://store.example.com/") {
+		t.Fatalf("status %d, location %s", w.Code, w.Header().Get("Location"))
+	}
+	// Redirect is not a download, node may not follow it.
+	serversLock.RLock()
+	state := serversState["192.0.2.2"]
+	serversLock.RUnlock()
+	if state != nil && state.ReceivedConfVersion != 0 {
+		t.Fatalf("received version %d after redirect", state.ReceivedConfVersion)
+	}
+	if downloads() != before {
+		t.Fatal("redirect is counted as download")
+	}
+	// Report of the version counts download once.
+	for i := 0; i < 2; i++ {
+		r = httptest.NewRequest("POST", "/report", strings.NewReader(`{"version": 2, "test_ok": true}`))
+		r.RemoteAddr = "192.0.2.2:1234"
+		nodeReportHandler(httptest.NewRecorder(), r)
+	}
+	serversLock.RLock()
+	state = serversState["192.0.2.2"]
+	received, receivedTime := state.ReceivedConfVersion, state.LastConfReceivedTime
+	serversLock.RUnlock()
+	if received != 2 || receivedTime == 0 {
+		t.Fatalf("received version %d, time %d", received, receivedTime)
+	}
+	if downloads() != before+1 {
+		t.Fatalf("downloads %v, want %v", downloads(), before+1)
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var rollbackEnabled = flag.Bool("rollback.enabled",
+	getEnv("ROLLBACK_ENABLED", "false") == "true",
+	"Republish last known-good package if nodes fail to load new version.")
+
+var rollbackThreshold = flag.Float64("rollback.threshold",
+	getEnvFloat64("ROLLBACK_THRESHOLD", 0),
+	"Max part (0..1) of nodes allowed to fail new version before rollback.")
+
+var rollbackDeadline = flag.Int64("rollback.deadline",
+	getEnvInt64("ROLLBACK_DEADLINE", 180),
+	"Seconds for all nodes to load new version (without rollout waves).")
+
+// Last version loaded by all nodes without errors.
+var lastGoodVersion int
+var lastGoodLock sync.Mutex
+
+// File in configsPkgsDir to keep last good version between restarts, it's stored with versions files.
+const lastGoodFileName = "last_good_version"
+
+// Read last good version from configsPkgsDir or store.
+func loadLastGoodVersion() {
+	name := *configsPkgsDir + "/" + lastGoodFileName
+	err := ensureLocal(name)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Can't load last good version: %s", err.Error())
+		}
+		return
+	}
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return
+	}
+	version, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		log.Printf("Bad last good version file: %s", err.Error())
+		return
+	}
+	lastGoodLock.Lock()
+	lastGoodVersion = version
+	lastGoodLock.Unlock()
+	log.Printf("Last good config version: %d", version)
+}
+
+// Get last good version, 0 - unknown.
+func getLastGoodVersion() int {
+	lastGoodLock.Lock()
+	defer lastGoodLock.Unlock()
+	return lastGoodVersion
+}
+
+// Remember version as last good.
+func setLastGoodVersion(version int) {
+	lastGoodLock.Lock()
+	defer lastGoodLock.Unlock()
+	if version <= lastGoodVersion {
+		return
+	}
+	lastGoodVersion = version
+	name := *configsPkgsDir + "/" + lastGoodFileName
+	err := ioutil.WriteFile(name, []byte(strconv.Itoa(version)), os.FileMode(0644))
+	if err == nil {
+		err = storeFiles(name)
+	}
+	if err != nil {
+		log.Printf("Can't save last good version: %s", err.Error())
+	}
+}
+
+// Marker file of bad version, it's stored with versions files.
+func badVersionFile(version int) string {
+	return fmt.Sprintf("%s/%d.bad", *configsPkgsDir, version)
+}
+
+// Mark version as bad, bad versions are never served.
+func markVersionBad(version int, reason string) {
+	err := ioutil.WriteFile(badVersionFile(version), []byte(reason+"\n"), os.FileMode(0644))
+	if err == nil {
+		err = storeFiles(badVersionFile(version))
+	}
+	if err != nil {
+		log.Printf("Can't mark version %d as bad: %s", version, err.Error())
+		return
+	}
+	log.Printf("Version %d marked as bad: %s", version, reason)
+}
+
+// Return true if version is marked as bad. Local copy is checked, stored markers are
+// copied at start (see loadVersionMarkers), so /getconf doesn't request store.
+func isVersionBad(version int) bool {
+	_, err := os.Stat(badVersionFile(version))
+	return err == nil
+}
+
+// Wait for all nodes load version (rollout without waves) and check result.
+func watchConvergence(state *rolloutState) {
+	failed, canceled := waitForNodes(time.Duration(*rollbackDeadline)*time.Second, state.Version, sortedServerHosts(), state.cancel)
+	if canceled {
+		return
+	}
+	if len(failed) == 0 {
+		convergenceSeconds.Observe(float64(time.Now().Unix() - state.Started))
+	}
+	hosts := sortedServerHosts()
+	failed = uniqStrings(append(failed, nodesWithErrors(state.Version, hosts)...))
+	if !tooManyFailed(failed, len(hosts), *rollbackThreshold) {
+		setLastGoodVersion(state.Version)
+		return
+	}
+	rolloutLock.Lock()
+	state.Status = rolloutFailed
+	state.FailedNodes = failed
+	rolloutLock.Unlock()
+	publishEvent(controllerEvent{Type: eventRolloutProgress, Version: state.Version, Data: rolloutEventData{Status: rolloutFailed, Nodes: failed}})
+	rollbackFailed(state, failed)
+}
+
+// Nodes from list which received version and reported load error.
+func nodesWithErrors(version int, hosts []string) []string {
+	serversLock.RLock()
+	defer serversLock.RUnlock()
+	var result []string
+	for _, host := range hosts {
+		state, ok := serversState[host]
+		if ok && state.LastErr != nil && state.ReceivedConfVersion >= version && state.CurentConfVersion < version {
+			result = append(result, host)
+		}
+	}
+	return result
+}
+
+// Return true if failed part of nodes is more than threshold.
+func tooManyFailed(failed []string, total int, threshold float64) bool {
+	return len(failed) > 0 && float64(len(failed)) > threshold*float64(total)
+}
+
+// Rollback failed version if rollback policy is enabled.
+func rollbackFailed(state *rolloutState, failed []string) {
+	log.Printf("Version %d failed on nodes: %s", state.Version, strings.Join(failed, ", "))
+	if !*rollbackEnabled || state.rollback {
+		return
+	}
+	reason := fmt.Sprintf("failed on nodes: %s", strings.Join(failed, ", "))
+	_, err := rollbackToGood(state.Version, reason)
+	if err != nil {
+		log.Printf("Rollback of version %d failed: %s", state.Version, err.Error())
+	}
+}
+
+// Mark version bad and republish last good package as new version.
+// Version is marked bad even without good version, so it's not served anymore.
+func rollbackToGood(badVersion int, reason string) (int, error) {
+	markVersionBad(badVersion, reason)
+	good := getLastGoodVersion()
+	if good == 0 || good == badVersion {
+		return 0, fmt.Errorf("No known-good version to rollback to")
+	}
+	publishLock.Lock()
+	version, err := republishVersion(good, auditRecord{Trigger: "rollback", Identity: "controller"})
+	publishLock.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	// Copy of last good version is good too, it's not checked again.
+	publishRollback(version)
+	setLastGoodVersion(version)
+	log.Printf("Rolled back from version %d to version %d (copy of %d)", badVersion, version, good)
+	return version, nil
+}
+
+// Copy packages of version 'from' to new config version and set it in Consul.
+// Result is written to audit log with caller info from record. Caller holds publishLock
+// and starts rollout of the new version.
+func republishVersion(from int, record auditRecord) (int, error) {
+	// Copy has the same metadata and templates as source version.
+	// Versions made before snapshots have no metadata, changes are unknown.
+	source, err := loadVersionInfo(from)
+	if err != nil {
+		source = &versionInfo{}
+	}
+	record.ChangedProjects, record.ChangedDomains = []string{}, []string{}
+	if source.Metadata != nil {
+		auditMetadata(&record, source.Metadata)
+	}
+	version, err := copyVersionPackages(from)
+	if err == nil {
+		info := versionInfo{Version: version, Source: versionSourceRollback, CopyOf: from, Identity: record.Identity, PackageHashes: packageHashes(version)}
+		info.TemplateHashes = source.TemplateHashes
+		info.Metadata = source.Metadata
+		if err = saveVersionInfo(info); err != nil {
+			log.Printf("Can't save version %d info: %s", version, err.Error())
+		}
+		record.PackageHashes = info.PackageHashes
+		// Version is published when all packages are copied.
+		err = setConsulConfVersion(version)
+	}
+	record.Version = version
+	record.Outcome = jobDone
+	if err != nil {
+		record.Outcome = jobFailed
+		record.Error = err.Error()
+		writeAudit(record)
+		return 0, err
+	}
+	writeAudit(record)
+	if source.Metadata != nil {
+		setAuditBaseline(source.Metadata)
+	}
+	return version, nil
+}
+
+// Repackage configs of version 'from' as next config version, version is not published.
+// Packages get new manifest with new version, so agents don't take them for replay of old version.
+func copyVersionPackages(from int) (int, error) {
+	for _, group := range nodeGroupNames() {
+		pkgName := fmt.Sprintf("%s/%d.tar.gz", groupDir(*configsPkgsDir, group), from)
+		if err := ensureLocal(pkgName); err != nil {
+			return 0, fmt.Errorf("Package of version %d is missing: %s", from, err.Error())
+		}
+	}
+	version, err := nextConsulConfVersion()
+	if err != nil {
+		return 0, err
+	}
+	for _, group := range nodeGroupNames() {
+		if err = repackageVersion(group, from, version); err != nil {
+			log.Println(err.Error())
+			return version, err
+		}
+	}
+	return version, nil
+}
+
+// Extract group package of version 'from' and package its files as version.
+// Template hashes are kept from old manifest, packages made before manifests have none.
+func repackageVersion(group string, from, version int) error {
+	pkg, err := os.Open(packageFileName(group, from, formatGzip))
+	if err != nil {
+		return err
+	}
+	defer pkg.Close()
+	dir, err := ioutil.TempDir("", "lb-repackage")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	if err = extractPackage(pkg, dir); err != nil {
+		return fmt.Errorf("Can't extract package of version %d: %s", from, err.Error())
+	}
+	var templates map[string]string
+	manifestPath := filepath.Join(dir, manifestName)
+	if data, err := ioutil.ReadFile(manifestPath); err == nil {
+		if manifest, err := parseManifest(data); err == nil {
+			templates = manifest.TemplateHashes
+		}
+		if err = os.Remove(manifestPath); err != nil {
+			return err
+		}
+	}
+	return pkgGroupConfigs(group, version, dir, templates)
+}
+
+// Endpoint POST /rollback
+// Republish package of version 'to' as new version to all nodes at once.
+// Request example: curl -X POST http://controller-host:8081/rollback?to=12345
+func rollbackHandler(w http.ResponseWriter, r *http.Request) {
+	to, err := strconv.Atoi(r.URL.Query().Get("to"))
+	if err != nil || to <= 0 {
+		http.Error(w, "Missing version number.", 400)
+		return
+	}
+	if isVersionBad(to) {
+		http.Error(w, "Version is marked as bad.", 409)
+		return
+	}
+	for _, group := range nodeGroupNames() {
+		if err := ensureLocal(fmt.Sprintf("%s/%d.tar.gz", groupDir(*configsPkgsDir, group), to)); err != nil {
+			http.Error(w, fmt.Sprintf("Package of version %d is missing.", to), 404)
+			return
+		}
+	}
+	// Publish lock is taken first, like in update job. Job started after the check
+	// publishes its version after this one.
+	publishLock.Lock()
+	jobsLock.Lock()
+	job := runningJob
+	jobsLock.Unlock()
+	if job != nil {
+		publishLock.Unlock()
+		http.Error(w, fmt.Sprintf("Update job %s is running. Try again later.", job.Id), 409)
+		return
+	}
+	sourceIp, _, _ := net.SplitHostPort(r.RemoteAddr)
+	version, err := republishVersion(to, auditRecord{Trigger: "rollback", Identity: requestIdentity(r), SourceIp: sourceIp})
+	if err == nil {
+		// Chosen version is not known to be good, it's checked like a new version.
+		beginRollout(version, nil, false)
+	}
+	publishLock.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	log.Printf("Version %d republished as version %d by %s", to, version, requestIdentity(r))
+	info, err := loadVersionInfo(version)
+	if err != nil {
+		info = &versionInfo{Version: version, Source: versionSourceRollback, CopyOf: to}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// Copy file content.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Remove duplicates from list.
+func uniqStrings(list []string) []string {
+	seen := make(map[string]bool)
+	var result []string
+	for _, item := range list {
+		if !seen[item] {
+			seen[item] = true
+			result = append(result, item)
+		}
+	}
+	return result
+}
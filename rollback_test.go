@@ -0,0 +1,354 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRepackageVersion(t *testing.T) {
+	testPkgsDir(t)
+	files := map[string]string{"site.conf": "server { listen 80; }", "sites/api.conf": "server { listen 8080; }"}
+	testPublishVersion(t, 3, files)
+	if err := repackageVersion(*defaultGroup, 3, 7); err != nil {
+		t.Fatal(err)
+	}
+	for _, format := range []string{formatGzip, formatZstd} {
+		pkg, err := os.Open(packageFileName(*defaultGroup, 7, format))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir := t.TempDir()
+		err = extractPackage(pkg, dir)
+		pkg.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Embedded manifest is of new version, so agents accept republished package.
+		data, err := ioutil.ReadFile(filepath.Join(dir, manifestName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifest, err := parseManifest(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if manifest.Version != 7 || manifest.Group != *defaultGroup {
+			t.Fatalf("%s manifest of version %d group %s", format, manifest.Version, manifest.Group)
+		}
+		os.Remove(filepath.Join(dir, manifestName))
+		if got := readTestFiles(t, dir); !reflect.DeepEqual(got, files) {
+			t.Fatalf("%s files %v, want %v", format, got, files)
+		}
+		if drift, err := manifestDrift(manifest, dir); err != nil || len(drift) > 0 {
+			t.Fatalf("%s drift %v, %v", format, drift, err)
+		}
+	}
+	data, err := ioutil.ReadFile(manifestFileName(*defaultGroup, 7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest, err := parseManifest(data); err != nil || manifest.Version != 7 {
+		t.Fatalf("saved manifest: %v, %v", manifest, err)
+	}
+	if err := repackageVersion(*defaultGroup, 4, 8); err == nil {
+		t.Fatal("missing version is repackaged")
+	}
+}
+
+func TestNodesWithErrors(t *testing.T) {
+	testServers(t, map[string]*ServerInfo{
+		"failed":       {CurentConfVersion: 4, ReceivedConfVersion: 5, LastErr: errors.New("config test failed")},
+		"old error":    {CurentConfVersion: 4, ReceivedConfVersion: 4, LastErr: errors.New("config test failed")},
+		"loaded later": {CurentConfVersion: 5, ReceivedConfVersion: 5, LastErr: errors.New("poll failed")},
+		"waiting":      {CurentConfVersion: 4, ReceivedConfVersion: 5},
+		"newer failed": {CurentConfVersion: 4, ReceivedConfVersion: 6, LastErr: errors.New("config test failed")},
+	})
+	got := nodesWithErrors(5, []string{"failed", "old error", "loaded later", "waiting", "newer failed", "unknown"})
+	if want := []string{"failed", "newer failed"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("nodes with errors %v, want %v", got, want)
+	}
+}
+
+func TestWatchConvergence(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold float64
+		servers   map[string]*ServerInfo
+		good      int
+		failed    []string
+	}{
+		{
+			name:    "all nodes loaded",
+			servers: map[string]*ServerInfo{"a": {CurentConfVersion: 5}, "b": {CurentConfVersion: 6}},
+			good:    5,
+		},
+		{
+			name: "node failed",
+			servers: map[string]*ServerInfo{
+				"a": {CurentConfVersion: 5},
+				"b": {CurentConfVersion: 4, ReceivedConfVersion: 5, LastErr: errors.New("config test failed")},
+			},
+			failed: []string{"b"},
+		},
+		{
+			name:    "node not converged",
+			servers: map[string]*ServerInfo{"a": {CurentConfVersion: 5}, "b": {CurentConfVersion: 4}},
+			failed:  []string{"b"},
+		},
+		{
+			name: "failures under threshold", threshold: 0.5,
+			servers: map[string]*ServerInfo{"a": {CurentConfVersion: 5}, "b": {CurentConfVersion: 4}, "c": {CurentConfVersion: 5}},
+			good:    5,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testPkgsDir(t)
+			testRolloutFlags(t, 0, 0, test.threshold)
+			testServers(t, test.servers)
+			state := testRolloutState(5, 4, 0)
+			state.Status = rolloutDone
+			watchConvergence(state)
+			if getLastGoodVersion() != test.good {
+				t.Fatalf("last good %d, want %d", getLastGoodVersion(), test.good)
+			}
+			wantStatus := rolloutDone
+			if test.failed != nil {
+				wantStatus = rolloutFailed
+			}
+			if state.Status != wantStatus || !reflect.DeepEqual(state.FailedNodes, test.failed) {
+				t.Fatalf("status %s, failed %v", state.Status, state.FailedNodes)
+			}
+		})
+	}
+}
+
+func TestRollbackToGoodMarksBad(t *testing.T) {
+	testPkgsDir(t)
+	testRolloutFlags(t, 0, 0, 0)
+	// No good version: nothing to republish, failed version is not served anyway.
+	if _, err := rollbackToGood(5, "failed on nodes: a"); err == nil {
+		t.Fatal("rollback without good version succeeded")
+	}
+	if !isVersionBad(5) {
+		t.Fatal("failed version is not marked bad")
+	}
+}
+
+// Consul stand-in keeping config version key, version PUTs are counted.
+type testConsul struct {
+	lock    sync.Mutex
+	version int
+	puts    int
+	// Called before version PUT is handled.
+	putHook func()
+}
+
+func newTestConsul(t *testing.T, version int) *testConsul {
+	consul := &testConsul{version: version}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/kv/"+*configVersionKey {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method == http.MethodPut && consul.putHook != nil {
+			consul.putHook()
+		}
+		consul.lock.Lock()
+		defer consul.lock.Unlock()
+		if r.Method == http.MethodPut {
+			data, _ := ioutil.ReadAll(r.Body)
+			consul.version, _ = strconv.Atoi(string(data))
+			consul.puts++
+			return
+		}
+		fmt.Fprint(w, consul.version)
+	}))
+	t.Cleanup(server.Close)
+	oldUrl := *consulUrl
+	*consulUrl = strings.TrimPrefix(server.URL, "http://")
+	t.Cleanup(func() { *consulUrl = oldUrl })
+	return consul
+}
+
+// Audit log records.
+func testAuditRecords(t *testing.T) []auditRecord {
+	data, err := ioutil.ReadFile(auditFileName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []auditRecord
+	for _, line := range splitLines(string(data)) {
+		var record auditRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestRepublishVersionAudit(t *testing.T) {
+	testPkgsDir(t)
+	testRolloutFlags(t, 0, 0, 0)
+	newTestConsul(t, 5)
+	defer setAuditBaseline(nil)
+	good := projectsMetadataType{"p1": {Version: "1"}, "p2": {Version: "1"}}
+	failed := projectsMetadataType{"p1": {Version: "2"}, "p2": {Version: "1"}}
+	testPublishVersion(t, 3, map[string]string{"a.conf": "a"})
+	testPublishVersion(t, 4, map[string]string{"a.conf": "a"})
+	if err := saveVersionInfo(versionInfo{Version: 3, Source: versionSourceUpdate, Metadata: good}); err != nil {
+		t.Fatal(err)
+	}
+	setAuditBaseline(failed)
+
+	version, err := republishVersion(3, auditRecord{Trigger: "rollback", Identity: "ops"})
+	if err != nil || version != 6 {
+		t.Fatalf("republished version %d, %v", version, err)
+	}
+	records := testAuditRecords(t)
+	record := records[len(records)-1]
+	if record.Version != 6 || record.Outcome != jobDone || record.MetadataHash != metadataHash(good) {
+		t.Fatalf("audit record %+v", record)
+	}
+	if !reflect.DeepEqual(record.ChangedProjects, []string{"p1"}) {
+		t.Fatalf("changed projects %v", record.ChangedProjects)
+	}
+	// Next changes are listed against republished version.
+	next := auditRecord{}
+	auditMetadata(&next, good)
+	if len(next.ChangedProjects) != 0 {
+		t.Fatalf("baseline is not moved to republished version: %v", next.ChangedProjects)
+	}
+
+	// Version without metadata snapshot: changes are empty lists, not null.
+	if _, err = republishVersion(4, auditRecord{Trigger: "rollback", Identity: "ops"}); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(auditFileName())
+	lines := splitLines(string(data))
+	if last := lines[len(lines)-1]; !strings.Contains(last, `"changed_projects":[]`) || !strings.Contains(last, `"changed_domains":[]`) {
+		t.Fatalf("audit record %s", last)
+	}
+}
+
+// Wait for rollout status, rollout is checked in background.
+func testWaitRollout(t *testing.T, version int, status string) *rolloutState {
+	for i := 0; i < 100; i++ {
+		rolloutLock.Lock()
+		state := rollout
+		done := state.Version == version && state.Status == status
+		rolloutLock.Unlock()
+		if done {
+			return state
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("rollout of version %d is not %s", version, status)
+	return nil
+}
+
+func TestRollbackHandlerChecksVersion(t *testing.T) {
+	testPkgsDir(t)
+	testRolloutFlags(t, 0, 0, 0)
+	testServers(t, map[string]*ServerInfo{"a": {CurentConfVersion: 4}})
+	newTestConsul(t, 5)
+	testPublishVersion(t, 3, map[string]string{"a.conf": "a"})
+
+	w := httptest.NewRecorder()
+	rollbackHandler(w, testRoleRequest("POST", "/rollback?to=3", roleOperator, nil))
+	if w.Code != 200 {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+	// Manual rollback is watched like a new version, node didn't load it, so it's not good.
+	state := testWaitRollout(t, 6, rolloutFailed)
+	if state.rollback || getLastGoodVersion() != 0 {
+		t.Fatalf("rollback rollout: %v, last good %d", state.rollback, getLastGoodVersion())
+	}
+}
+
+func TestRollbackToGoodSetsLastGood(t *testing.T) {
+	testPkgsDir(t)
+	testRolloutFlags(t, 0, 0, 0)
+	newTestConsul(t, 5)
+	testPublishVersion(t, 3, map[string]string{"a.conf": "a"})
+	setLastGoodVersion(3)
+
+	version, err := rollbackToGood(5, "failed on nodes: a")
+	if err != nil || version != 6 {
+		t.Fatalf("rollback version %d, %v", version, err)
+	}
+	rolloutLock.Lock()
+	state := rollout
+	rolloutLock.Unlock()
+	if !state.rollback || state.Version != 6 || getLastGoodVersion() != 6 || !isVersionBad(5) {
+		t.Fatalf("rollout %+v, last good %d", state, getLastGoodVersion())
+	}
+}
+
+func TestRollbackHandlerLocks(t *testing.T) {
+	testPkgsDir(t)
+	testRolloutFlags(t, 0, 0, 0)
+	consul := newTestConsul(t, 5)
+	testPublishVersion(t, 3, map[string]string{"a.conf": "a"})
+
+	jobsLock.Lock()
+	runningJob = &updateJob{Id: "job1"}
+	jobsLock.Unlock()
+	w := httptest.NewRecorder()
+	rollbackHandler(w, testRoleRequest("POST", "/rollback?to=3", roleOperator, nil))
+	jobsLock.Lock()
+	runningJob = nil
+	jobsLock.Unlock()
+	if w.Code != 409 {
+		t.Fatalf("rollback during job: status %d", w.Code)
+	}
+
+	// Jobs lock is not held while version is published, job status requests are not blocked.
+	published, release := make(chan struct{}), make(chan struct{})
+	consul.putHook = func() {
+		close(published)
+		<-release
+	}
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		rollbackHandler(w, testRoleRequest("POST", "/rollback?to=3", roleOperator, nil))
+		done <- w.Code
+	}()
+	<-published
+	locked := make(chan struct{})
+	go func() {
+		jobsLock.Lock()
+		jobsLock.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("jobs lock is held during rollback publish")
+	}
+	close(release)
+	if code := <-done; code != 200 {
+		t.Fatalf("rollback status %d", code)
+	}
+	// No nodes, version is good when convergence watch is done.
+	for i := 0; i < 100 && getLastGoodVersion() != 6; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if getLastGoodVersion() != 6 {
+		t.Fatalf("last good %d", getLastGoodVersion())
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Staged rollout of config version.
+// Nodes from started waves may take Version, others stay on StableVersion.
+type rolloutState struct {
+	Version       int
+	StableVersion int
+	Wave          int
+	WavesCount    int
+	Status        string
+	Started       int64
+	WaveStarted   int64
+	Allowed       map[string]bool
+	FailedNodes   []string
+	// Closed when rollout is replaced by newer one.
+	cancel chan struct{}
+	// Rollout of republished good version, never rolled back.
+	rollback bool
+}
+
+// Rollout statuses.
+const (
+	rolloutRunning = "running"
+	rolloutDone    = "done"
+	rolloutFailed  = "failed"
+)
+
+var rollout = &rolloutState{Status: rolloutDone}
+var rolloutLock sync.Mutex
+
+var rolloutWaves = flag.String("rollout.waves",
+	getEnv("ROLLOUT_WAVES", ""),
+	"Cumulative rollout wave sizes, nodes count or percent, example: '1,25%,100%'. Empty - all nodes at once.")
+
+var rolloutBake = flag.Int64("rollout.bake",
+	getEnvInt64("ROLLOUT_BAKE", 60),
+	"Seconds to wait after wave is converged before next wave.")
+
+var rolloutWaveTimeout = flag.Int64("rollout.wave.timeout",
+	getEnvInt64("ROLLOUT_WAVE_TIMEOUT", 120),
+	"Seconds to wait for wave nodes to load new config version.")
+
+var rolloutFailThreshold = flag.Float64("rollout.fail.threshold",
+	getEnvFloat64("ROLLOUT_FAIL_THRESHOLD", 0),
+	"Max part (0..1) of wave nodes allowed to fail before rollout is stopped.")
+
+// Parse wave sizes flag. Each wave is a nodes count ('2') or percent of nodes ('25%').
+func parseRolloutWaves(wavesStr string) ([]string, error) {
+	var waves []string
+	for _, wave := range strings.Split(wavesStr, ",") {
+		wave = strings.TrimSpace(wave)
+		if wave == "" {
+			continue
+		}
+		num, err := strconv.Atoi(strings.TrimSuffix(wave, "%"))
+		if err != nil || num <= 0 {
+			return nil, fmt.Errorf("Bad rollout wave size: '%s'", wave)
+		}
+		waves = append(waves, wave)
+	}
+	return waves, nil
+}
+
+// Nodes count for wave size and total nodes count.
+func waveNodesCount(wave string, total int) int {
+	if strings.HasSuffix(wave, "%") {
+		percent, _ := strconv.Atoi(strings.TrimSuffix(wave, "%"))
+		count := (total*percent + 99) / 100
+		if count > total {
+			count = total
+		}
+		return count
+	}
+	count, _ := strconv.Atoi(wave)
+	if count > total {
+		count = total
+	}
+	return count
+}
+
+// Config version node may load now.
+func nodeTargetVersion(host string) int {
+	rolloutLock.Lock()
+	defer rolloutLock.Unlock()
+	if rollout.Status == rolloutDone || rollout.Allowed[host] {
+		return rollout.Version
+	}
+	return rollout.StableVersion
+}
+
+// Start staged rollout of new published version. Running rollout is replaced.
+func startRollout(version int) {
+	waves, err := parseRolloutWaves(*rolloutWaves)
+	if err != nil {
+		log.Printf("%s, rollout to all nodes at once.", err.Error())
+	}
+	beginRollout(version, waves, false)
+}
+
+// Publish rolled back version to all nodes at once.
+func publishRollback(version int) {
+	beginRollout(version, nil, true)
+}
+
+// Replace running rollout by rollout of version. Without waves version is allowed for all nodes.
+func beginRollout(version int, waves []string, rollback bool) {
+	rolloutLock.Lock()
+	if rollout.Status == rolloutRunning {
+		log.Printf("Rollout of version %d replaced by version %d", rollout.Version, version)
+		close(rollout.cancel)
+	}
+	stable := rollout.StableVersion
+	if rollout.Status == rolloutDone {
+		stable = rollout.Version
+	}
+	if stable == 0 {
+		stable = version - 1
+	}
+	rollout = &rolloutState{
+		Version:       version,
+		StableVersion: stable,
+		WavesCount:    len(waves),
+		Status:        rolloutRunning,
+		Started:       time.Now().Unix(),
+		Allowed:       make(map[string]bool),
+		cancel:        make(chan struct{}),
+		rollback:      rollback,
+	}
+	if len(waves) == 0 {
+		rollout.Status = rolloutDone
+		rollout.StableVersion = version
+	}
+	state := rollout
+	rolloutLock.Unlock()
+	notifyVersionWatchers()
+	publishEvent(controllerEvent{Type: eventVersionPublished, Version: version, OldVersion: stable, Data: rolloutEventData{Status: state.Status, Waves: len(waves)}})
+
+	if len(waves) == 0 {
+		log.Printf("Version %d published to all nodes.", version)
+		if !rollback {
+			go watchConvergence(state)
+		}
+		return
+	}
+	go runRollout(state, waves)
+}
+
+// Rollout waves processing. Wave nodes are allowed to take new version, then controller waits
+// for wave convergence and bake time before next wave.
+func runRollout(state *rolloutState, waves []string) {
+	for i, wave := range waves {
+		hosts := sortedServerHosts()
+		count := waveNodesCount(wave, len(hosts))
+		var waveHosts []string
+		rolloutLock.Lock()
+		for _, host := range hosts[:count] {
+			if !state.Allowed[host] {
+				state.Allowed[host] = true
+				waveHosts = append(waveHosts, host)
+			}
+		}
+		state.Wave = i + 1
+		state.WaveStarted = time.Now().Unix()
+		rolloutLock.Unlock()
+		notifyVersionWatchers()
+		log.Printf("Rollout of version %d: wave %d/%d started, nodes: %s", state.Version, i+1, len(waves), strings.Join(waveHosts, ", "))
+		publishEvent(controllerEvent{Type: eventRolloutProgress, Version: state.Version, Data: rolloutEventData{rolloutRunning, i + 1, len(waves), waveHosts}})
+
+		failed, canceled := waitForNodes(time.Duration(*rolloutWaveTimeout)*time.Second, state.Version, waveHosts, state.cancel)
+		if canceled {
+			return
+		}
+		failed = uniqStrings(append(failed, nodesWithErrors(state.Version, waveHosts)...))
+		if tooManyFailed(failed, len(waveHosts), *rolloutFailThreshold) {
+			rolloutLock.Lock()
+			state.Status = rolloutFailed
+			state.FailedNodes = failed
+			rolloutLock.Unlock()
+			log.Printf("Rollout of version %d failed on wave %d, nodes not converged: %s", state.Version, i+1, strings.Join(failed, ", "))
+			publishEvent(controllerEvent{Type: eventRolloutProgress, Version: state.Version, Data: rolloutEventData{rolloutFailed, i + 1, len(waves), failed}})
+			rollbackFailed(state, failed)
+			return
+		}
+		if i == len(waves)-1 {
+			break
+		}
+		// Bake time before next wave.
+		select {
+		case <-state.cancel:
+			return
+		case <-time.After(time.Duration(*rolloutBake) * time.Second):
+		}
+	}
+	rolloutLock.Lock()
+	state.Status = rolloutDone
+	state.StableVersion = state.Version
+	rolloutLock.Unlock()
+	notifyVersionWatchers()
+	convergenceSeconds.Observe(float64(time.Now().Unix() - state.Started))
+	setLastGoodVersion(state.Version)
+	log.Printf("Rollout of version %d done.", state.Version)
+	publishEvent(controllerEvent{Type: eventRolloutProgress, Version: state.Version, Data: rolloutEventData{rolloutDone, len(waves), len(waves), nil}})
+}
+
+// Wait for nodes from 'hosts' list load config version 'ver' or hight.
+// Return nodes which did not load version before timeout. Nodes removed from list are ignored.
+func waitForNodes(timeout time.Duration, ver int, hosts []string, cancel <-chan struct{}) (failed []string, canceled bool) {
+	tm := time.After(timeout)
+	tick := time.NewTicker(2 * time.Second)
+	defer tick.Stop()
+	for {
+		failed = nil
+		serversLock.RLock()
+		for _, host := range hosts {
+			if state, ok := serversState[host]; ok && state.CurentConfVersion < ver {
+				failed = append(failed, host)
+			}
+		}
+		serversLock.RUnlock()
+		if len(failed) == 0 {
+			return nil, false
+		}
+		select {
+		case <-cancel:
+			return failed, true
+		case <-tm:
+			return failed, false
+		case <-tick.C:
+		}
+	}
+}
+
+// Registered nodes list in stable order, used for waves nodes selection.
+func sortedServerHosts() []string {
+	serversLock.RLock()
+	defer serversLock.RUnlock()
+	hosts := make([]string, 0, len(serversState))
+	for host := range serversState {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// Return readable rollout progress.
+func getRolloutStatus() string {
+	rolloutLock.Lock()
+	defer rolloutLock.Unlock()
+	result := fmt.Sprintf("Rollout version: %d; stable version: %d; status: %s\n", rollout.Version, rollout.StableVersion, rollout.Status)
+	if rollout.WavesCount > 0 {
+		result += fmt.Sprintf(" wave: %d/%d; allowed nodes: %d; started (seconds ago): %d\n", rollout.Wave, rollout.WavesCount, len(rollout.Allowed), time.Now().Unix()-rollout.Started)
+	}
+	if len(rollout.FailedNodes) > 0 {
+		result += fmt.Sprintf(" failed nodes: %s\n", strings.Join(rollout.FailedNodes, ", "))
+	}
+	return result + "\n"
+}
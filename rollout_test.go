@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Replace nodes list for test.
+func testServers(t *testing.T, servers map[string]*ServerInfo) {
+	serversLock.Lock()
+	oldServers := serversState
+	serversState = servers
+	serversLock.Unlock()
+	t.Cleanup(func() {
+		serversLock.Lock()
+		serversState = oldServers
+		serversLock.Unlock()
+	})
+}
+
+// Set rollout and rollback flags, reset rollout and last good version for test.
+// Automatic rollback stays disabled (default).
+func testRolloutFlags(t *testing.T, waveTimeout, bake int64, threshold float64) {
+	oldTimeout, oldBake, oldThreshold, oldDeadline := *rolloutWaveTimeout, *rolloutBake, *rolloutFailThreshold, *rollbackDeadline
+	oldRollbackThreshold := *rollbackThreshold
+	*rolloutWaveTimeout, *rolloutBake, *rolloutFailThreshold = waveTimeout, bake, threshold
+	*rollbackDeadline, *rollbackThreshold = waveTimeout, threshold
+	rolloutLock.Lock()
+	oldRollout := rollout
+	rollout = &rolloutState{Status: rolloutDone}
+	rolloutLock.Unlock()
+	lastGoodLock.Lock()
+	oldGood := lastGoodVersion
+	lastGoodVersion = 0
+	lastGoodLock.Unlock()
+	t.Cleanup(func() {
+		*rolloutWaveTimeout, *rolloutBake, *rolloutFailThreshold, *rollbackDeadline = oldTimeout, oldBake, oldThreshold, oldDeadline
+		*rollbackThreshold = oldRollbackThreshold
+		rolloutLock.Lock()
+		rollout = oldRollout
+		rolloutLock.Unlock()
+		lastGoodLock.Lock()
+		lastGoodVersion = oldGood
+		lastGoodLock.Unlock()
+	})
+}
+
+// Running rollout state of version, as beginRollout makes it.
+func testRolloutState(version, stable, waves int) *rolloutState {
+	return &rolloutState{
+		Version: version, StableVersion: stable, WavesCount: waves, Status: rolloutRunning,
+		Started: time.Now().Unix(), Allowed: make(map[string]bool), cancel: make(chan struct{}),
+	}
+}
+
+func TestParseRolloutWaves(t *testing.T) {
+	tests := []struct {
+		waves string
+		want  []string
+		ok    bool
+	}{
+		{"", nil, true},
+		{"1,25%,100%", []string{"1", "25%", "100%"}, true},
+		{" 2 , 50% ,", []string{"2", "50%"}, true},
+		{"1,,3", []string{"1", "3"}, true},
+		{"0,100%", nil, false},
+		{"1,-5", nil, false},
+		{"0%", nil, false},
+		{"a", nil, false},
+		{"10%%", nil, false},
+		{"1.5", nil, false},
+	}
+	for _, test := range tests {
+		waves, err := parseRolloutWaves(test.waves)
+		if (err == nil) != test.ok {
+			t.Fatalf("%q: error %v, want ok: %v", test.waves, err, test.ok)
+		}
+		if !reflect.DeepEqual(waves, test.want) {
+			t.Fatalf("%q: waves %q, want %q", test.waves, waves, test.want)
+		}
+	}
+}
+
+func TestWaveNodesCount(t *testing.T) {
+	tests := []struct {
+		wave  string
+		total int
+		count int
+	}{
+		{"1", 10, 1},
+		{"3", 2, 2},
+		{"25%", 10, 3},
+		{"25%", 4, 1},
+		{"1%", 3, 1},
+		{"50%", 3, 2},
+		{"100%", 7, 7},
+		{"200%", 7, 7},
+		{"10%", 0, 0},
+		{"2", 0, 0},
+	}
+	for _, test := range tests {
+		if count := waveNodesCount(test.wave, test.total); count != test.count {
+			t.Fatalf("wave %s of %d nodes: %d, want %d", test.wave, test.total, count, test.count)
+		}
+	}
+}
+
+func TestTooManyFailed(t *testing.T) {
+	tests := []struct {
+		failed    int
+		total     int
+		threshold float64
+		want      bool
+	}{
+		{0, 10, 0, false},
+		{1, 10, 0, true},
+		{1, 10, 0.1, false},
+		{2, 10, 0.1, true},
+		{5, 10, 0.5, false},
+		{6, 10, 0.5, true},
+		{3, 3, 1, false},
+		{0, 0, 0, false},
+	}
+	for _, test := range tests {
+		failed := make([]string, test.failed)
+		if got := tooManyFailed(failed, test.total, test.threshold); got != test.want {
+			t.Fatalf("%d of %d failed, threshold %v: %v, want %v", test.failed, test.total, test.threshold, got, test.want)
+		}
+	}
+}
+
+func TestRunRollout(t *testing.T) {
+	testPkgsDir(t)
+	tests := []struct {
+		name      string
+		waves     []string
+		threshold float64
+		servers   map[string]*ServerInfo
+		status    string
+		allowed   []string
+		failed    []string
+	}{
+		{
+			name: "all waves converged", waves: []string{"1", "50%", "100%"},
+			servers: map[string]*ServerInfo{"a": {CurentConfVersion: 5}, "b": {CurentConfVersion: 5}, "c": {CurentConfVersion: 6}},
+			status:  rolloutDone, allowed: []string{"a", "b", "c"},
+		},
+		{
+			name: "first wave node failed", waves: []string{"1", "100%"},
+			servers: map[string]*ServerInfo{
+				"a": {CurentConfVersion: 4, ReceivedConfVersion: 5, LastErr: errors.New("config test failed")},
+				"b": {CurentConfVersion: 5},
+			},
+			status: rolloutFailed, allowed: []string{"a"}, failed: []string{"a"},
+		},
+		{
+			name: "second wave timeout", waves: []string{"1", "100%"},
+			servers: map[string]*ServerInfo{"a": {CurentConfVersion: 5}, "b": {CurentConfVersion: 4}, "c": {CurentConfVersion: 4}},
+			status:  rolloutFailed, allowed: []string{"a", "b", "c"}, failed: []string{"b", "c"},
+		},
+		{
+			name: "failures under threshold", waves: []string{"100%"}, threshold: 0.5,
+			servers: map[string]*ServerInfo{"a": {CurentConfVersion: 5}, "b": {CurentConfVersion: 4}, "c": {CurentConfVersion: 5}},
+			status:  rolloutDone, allowed: []string{"a", "b", "c"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testRolloutFlags(t, 0, 0, test.threshold)
+			testServers(t, test.servers)
+			state := testRolloutState(5, 4, len(test.waves))
+			runRollout(state, test.waves)
+			if state.Status != test.status {
+				t.Fatalf("status %s, want %s", state.Status, test.status)
+			}
+			var allowed []string
+			for _, host := range sortedServerHosts() {
+				if state.Allowed[host] {
+					allowed = append(allowed, host)
+				}
+			}
+			if !reflect.DeepEqual(allowed, test.allowed) {
+				t.Fatalf("allowed %v, want %v", allowed, test.allowed)
+			}
+			if !reflect.DeepEqual(state.FailedNodes, test.failed) {
+				t.Fatalf("failed %v, want %v", state.FailedNodes, test.failed)
+			}
+			// Only finished rollout makes version stable and last good.
+			good := 0
+			if test.status == rolloutDone {
+				good = 5
+			}
+			if getLastGoodVersion() != good || (state.StableVersion == 5) != (good == 5) {
+				t.Fatalf("last good %d, stable %d", getLastGoodVersion(), state.StableVersion)
+			}
+		})
+	}
+}
+
+func TestRunRolloutCanceled(t *testing.T) {
+	testPkgsDir(t)
+	testRolloutFlags(t, 60, 0, 0)
+	testServers(t, map[string]*ServerInfo{"a": {CurentConfVersion: 4}, "b": {CurentConfVersion: 4}})
+	state := testRolloutState(5, 4, 2)
+	done := make(chan struct{})
+	go func() {
+		runRollout(state, []string{"1", "100%"})
+		close(done)
+	}()
+	close(state.cancel)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("canceled rollout is still running")
+	}
+	rolloutLock.Lock()
+	status, allowed := state.Status, len(state.Allowed)
+	rolloutLock.Unlock()
+	if status != rolloutRunning || allowed != 1 || getLastGoodVersion() != 0 {
+		t.Fatalf("canceled rollout status %s, allowed nodes %d, last good %d", status, allowed, getLastGoodVersion())
+	}
+}
+
+func TestBeginRolloutReplaces(t *testing.T) {
+	testPkgsDir(t)
+	testRolloutFlags(t, 60, 0, 0)
+	testServers(t, map[string]*ServerInfo{"a": {CurentConfVersion: 4}, "b": {CurentConfVersion: 4}})
+	rolloutLock.Lock()
+	rollout = &rolloutState{Version: 4, StableVersion: 4, Status: rolloutDone}
+	rolloutLock.Unlock()
+
+	beginRollout(5, []string{"1", "100%"}, false)
+	rolloutLock.Lock()
+	first := rollout
+	rolloutLock.Unlock()
+	if first.Version != 5 || first.StableVersion != 4 || first.Status != rolloutRunning {
+		t.Fatalf("rollout %+v", first)
+	}
+	// New version replaces running rollout, not converged version is not stable.
+	beginRollout(6, nil, true)
+	select {
+	case <-first.cancel:
+	default:
+		t.Fatal("replaced rollout is not canceled")
+	}
+	rolloutLock.Lock()
+	second := rollout
+	rolloutLock.Unlock()
+	if second.Version != 6 || second.Status != rolloutDone || second.StableVersion != 6 {
+		t.Fatalf("rollout %+v", second)
+	}
+	if nodeTargetVersion("a") != 6 || nodeTargetVersion("other") != 6 {
+		t.Fatal("version without waves is not allowed for all nodes")
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/template"
+	"time"
+)
+
+var shutdownTimeout = flag.Int64("shutdown.timeout",
+	getEnvInt64("SHUTDOWN_TIMEOUT", 30),
+	"Seconds to drain in-flight requests and running update on shutdown.")
+
+// Closed on shutdown. Long requests (/watch, /events) and waits return on it.
+var shuttingDown = make(chan struct{})
+
+// Process signals until shutdown.
+// SIGTERM/SIGINT - graceful shutdown, SIGHUP - reload templates and config files, SIGUSR1 - regenerate configs.
+func handleSignals(server *http.Server) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR1)
+	for sig := range sigs {
+		switch sig {
+		case syscall.SIGHUP:
+			log.Println("SIGHUP received, reloading configuration.")
+			reloadConfiguration()
+		case syscall.SIGUSR1:
+			log.Println("SIGUSR1 received, starting config regeneration.")
+			job, started := startUpdateJob("signal", "controller", "")
+			if !started {
+				log.Printf("Update job %s is running already.", job.Id)
+			}
+		default:
+			log.Printf("%s received, shutting down.", sig)
+			shutdown(server)
+			return
+		}
+	}
+}
+
+// Reload groups, API clients, signing keys and check templates. Broken files are logged and old settings are kept.
+func reloadConfiguration() {
+	if err := loadNodeGroups(); err != nil {
+		log.Printf("Node groups reload failed, old groups are kept: %s", err.Error())
+	}
+	if authEnabled() {
+		if err := loadAuthClients(); err != nil {
+			log.Printf("API clients reload failed, old clients are kept: %s", err.Error())
+		}
+	}
+	if err := loadSigningKeys(); err != nil {
+		log.Printf("Signing keys reload failed, old keys are kept: %s", err.Error())
+	}
+	_, err := template.ParseFiles(*vHostsTemplateFile, *vhostsSslTmpl, *vhostsNonSslTmpl)
+	if err != nil {
+		log.Printf("Templates check failed: %s", err.Error())
+		return
+	}
+	log.Println("Templates are ok, they are used on next update.")
+}
+
+// Stop accepting requests, drain in-flight requests, wait for running update job and save state.
+func shutdown(server *http.Server) {
+	close(shuttingDown)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(*shutdownTimeout)*time.Second)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	if err != nil {
+		log.Printf("Requests drain error: %s", err.Error())
+	}
+	jobsLock.Lock()
+	job := runningJob
+	jobsLock.Unlock()
+	if job != nil {
+		log.Printf("Waiting for update job %s.", job.Id)
+		select {
+		case <-job.done:
+		case <-ctx.Done():
+			log.Printf("Update job %s aborted by shutdown.", job.Id)
+		}
+	}
+	if err = saveState(); err != nil {
+		log.Printf("Can't save state: %s", err.Error())
+	}
+	log.Println("Controller stopped.")
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Response header with detached signatures of package or manifest.
+// Format: 'keyId:base64signature[,keyId2:base64signature2]'.
+const signatureHeader = "X-Signature"
+
+var signKeysFile = flag.String("sign.keys.file",
+	getEnv("SIGN_KEYS_FILE", ""),
+	"JSON file with ed25519 signing keys. Empty - packages are not signed.")
+
+// Signing key. Private key is base64 of ed25519 seed (32 bytes) or private key (64 bytes).
+type signingKey struct {
+	Id         string `json:"id"`
+	PrivateKey string `json:"private_key,omitempty"`
+	PublicKey  string `json:"public_key,omitempty"`
+}
+
+// Keys file format. Controller signs with all keys (several keys are active during rotation),
+// agent trusts all public keys.
+// Example: {"keys": [{"id": "2026-10", "private_key": "base64..."}]}
+type signingKeysConfig struct {
+	Keys []signingKey `json:"keys"`
+}
+
+// Active signing keys by id.
+var signingKeys map[string]ed25519.PrivateKey
+var signingKeysLock sync.RWMutex
+
+// Return true if packages signing is configured.
+func signingEnabled() bool {
+	return *signKeysFile != ""
+}
+
+// Read keys file.
+func readSigningKeysFile(name string) ([]signingKey, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var conf signingKeysConfig
+	err = json.Unmarshal(data, &conf)
+	if err != nil {
+		return nil, err
+	}
+	if len(conf.Keys) == 0 {
+		return nil, fmt.Errorf("No keys in %s", name)
+	}
+	return conf.Keys, nil
+}
+
+// Load signing keys. Old keys are kept if file is broken.
+func loadSigningKeys() error {
+	if !signingEnabled() {
+		return nil
+	}
+	keysList, err := readSigningKeysFile(*signKeysFile)
+	if err != nil {
+		log.Printf("Can't load signing keys: %s", err.Error())
+		return err
+	}
+	keys := make(map[string]ed25519.PrivateKey)
+	for _, key := range keysList {
+		raw, err := base64.StdEncoding.DecodeString(key.PrivateKey)
+		if err != nil {
+			log.Printf("Bad signing key %s: %s", key.Id, err.Error())
+			return err
+		}
+		switch len(raw) {
+		case ed25519.SeedSize:
+			keys[key.Id] = ed25519.NewKeyFromSeed(raw)
+		case ed25519.PrivateKeySize:
+			keys[key.Id] = ed25519.PrivateKey(raw)
+		default:
+			err = fmt.Errorf("Bad signing key %s size: %d", key.Id, len(raw))
+			log.Println(err.Error())
+			return err
+		}
+	}
+	signingKeysLock.Lock()
+	signingKeys = keys
+	signingKeysLock.Unlock()
+	log.Printf("Signing keys loaded: %d", len(keys))
+	return nil
+}
+
+// Load trusted public keys by id.
+func loadTrustedKeys(name string) (map[string]ed25519.PublicKey, error) {
+	keysList, err := readSigningKeysFile(name)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]ed25519.PublicKey)
+	for _, key := range keysList {
+		raw, err := base64.StdEncoding.DecodeString(key.PublicKey)
+		if err != nil || len(raw) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("bad public key %s", key.Id)
+		}
+		keys[key.Id] = ed25519.PublicKey(raw)
+	}
+	return keys, nil
+}
+
+// Detached signature file name.
+func signatureFile(name string) string {
+	return name + ".sig"
+}
+
+// Sign file with all signing keys, signatures are saved to detached signature file.
+func signFile(name string) error {
+	if !signingEnabled() {
+		return nil
+	}
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	signingKeysLock.RLock()
+	var signatures []string
+	for id, key := range signingKeys {
+		signatures = append(signatures, id+":"+base64.StdEncoding.EncodeToString(ed25519.Sign(key, data)))
+	}
+	signingKeysLock.RUnlock()
+	if len(signatures) == 0 {
+		return fmt.Errorf("No signing keys loaded")
+	}
+	tmpName := signatureFile(name) + ".tmp"
+	err = ioutil.WriteFile(tmpName, []byte(strings.Join(signatures, ",")), os.FileMode(0644))
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpName, signatureFile(name))
+}
+
+// Read detached signatures of file in header format.
+func readSignature(name string) (string, error) {
+	err := ensureLocal(signatureFile(name))
+	if err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadFile(signatureFile(name))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// Check that data has valid signature of at least one trusted key.
+func verifySignature(data []byte, signatures string, trusted map[string]ed25519.PublicKey) error {
+	if signatures == "" {
+		return fmt.Errorf("data is not signed")
+	}
+	for _, signature := range strings.Split(signatures, ",") {
+		parts := strings.SplitN(strings.TrimSpace(signature), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key, ok := trusted[parts[0]]
+		if !ok {
+			continue
+		}
+		raw, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			continue
+		}
+		if ed25519.Verify(key, data, raw) {
+			return nil
+		}
+	}
+	return fmt.Errorf("no valid signature of trusted keys")
+}
+
+// Generate signing key: 'lb-confgs-controller keygen <key id>'.
+// Private key is for controller keys file, public key - for agents trusted keys file.
+func runKeygen(args []string) {
+	id := "key1"
+	if len(args) > 0 {
+		id = args[0]
+	}
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	data, _ := json.MarshalIndent(signingKey{
+		Id:         id,
+		PrivateKey: base64.StdEncoding.EncodeToString(private.Seed()),
+		PublicKey:  base64.StdEncoding.EncodeToString(public),
+	}, "", "  ")
+	fmt.Println(string(data))
+}
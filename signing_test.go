@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+// Generate test signing key.
+func testKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return public, private
+}
+
+// Signature header of data signed with keys by id, in the order of ids.
+func testSignature(data []byte, ids []string, keys map[string]ed25519.PrivateKey) string {
+	var signatures []string
+	for _, id := range ids {
+		signatures = append(signatures, id+":"+base64.StdEncoding.EncodeToString(ed25519.Sign(keys[id], data)))
+	}
+	return strings.Join(signatures, ",")
+}
+
+func TestVerifySignature(t *testing.T) {
+	oldPublic, oldPrivate := testKey(t)
+	newPublic, newPrivate := testKey(t)
+	_, otherPrivate := testKey(t)
+	private := map[string]ed25519.PrivateKey{"old": oldPrivate, "new": newPrivate, "other": otherPrivate}
+	data := []byte("package data")
+	sign := func(ids ...string) string { return testSignature(data, ids, private) }
+	tests := []struct {
+		name      string
+		signature string
+		trusted   map[string]ed25519.PublicKey
+		data      string
+		ok        bool
+	}{
+		{"single key", sign("old"), map[string]ed25519.PublicKey{"old": oldPublic}, "", true},
+		// Rotation: controller signs with old and new keys, agents trust old, new or both.
+		{"rotation, agent trusts old key", sign("old", "new"), map[string]ed25519.PublicKey{"old": oldPublic}, "", true},
+		{"rotation, agent trusts new key", sign("old", "new"), map[string]ed25519.PublicKey{"new": newPublic}, "", true},
+		{"rotation, agent trusts both", sign("new", "old"), map[string]ed25519.PublicKey{"old": oldPublic, "new": newPublic}, "", true},
+		{"rotation done, old key removed from agent", sign("old"), map[string]ed25519.PublicKey{"new": newPublic}, "", false},
+		{"untrusted key", sign("other"), map[string]ed25519.PublicKey{"old": oldPublic}, "", false},
+		{"untrusted key with trusted id", "old:" + strings.SplitN(sign("other"), ":", 2)[1], map[string]ed25519.PublicKey{"old": oldPublic}, "", false},
+		{"wrong data", sign("old"), map[string]ed25519.PublicKey{"old": oldPublic}, "other data", false},
+		{"empty signature", "", map[string]ed25519.PublicKey{"old": oldPublic}, "", false},
+		{"no key id", strings.SplitN(sign("old"), ":", 2)[1], map[string]ed25519.PublicKey{"old": oldPublic}, "", false},
+		{"bad base64", "old:!!!", map[string]ed25519.PublicKey{"old": oldPublic}, "", false},
+		{"truncated signature", sign("old")[:20], map[string]ed25519.PublicKey{"old": oldPublic}, "", false},
+		{"malformed and valid", "garbage, old:!!!, " + sign("old"), map[string]ed25519.PublicKey{"old": oldPublic}, "", true},
+		{"no trusted keys", sign("old"), nil, "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			checked := data
+			if test.data != "" {
+				checked = []byte(test.data)
+			}
+			err := verifySignature(checked, test.signature, test.trusted)
+			if (err == nil) != test.ok {
+				t.Fatalf("verify error: %v, want ok: %v", err, test.ok)
+			}
+		})
+	}
+}
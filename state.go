@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+var stateFile = flag.String("state.file",
+	getEnv("STATE_FILE", ""),
+	"File to save nodes list and rollout on shutdown. Empty - <conf.pkg.dir>/controller_state.json.")
+
+// Controller state saved between restarts.
+type controllerState struct {
+	Nodes   []nodeStatus  `json:"nodes"`
+	Rollout rolloutStatus `json:"rollout"`
+	Allowed []string      `json:"allowed"`
+}
+
+// State file name.
+func stateFileName() string {
+	if *stateFile != "" {
+		return *stateFile
+	}
+	return *configsPkgsDir + "/controller_state.json"
+}
+
+// Save nodes list and rollout state.
+func saveState() error {
+	state := controllerState{Nodes: getNodesStatus(), Rollout: getRolloutStatusData()}
+	rolloutLock.Lock()
+	for host := range rollout.Allowed {
+		state.Allowed = append(state.Allowed, host)
+	}
+	rolloutLock.Unlock()
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmpName := stateFileName() + ".tmp"
+	err = ioutil.WriteFile(tmpName, data, os.FileMode(0600))
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpName, stateFileName())
+	if err != nil {
+		return err
+	}
+	log.Printf("State saved: %s", stateFileName())
+	return nil
+}
+
+// Load nodes list and rollout state saved on last shutdown.
+// Running rollout can't be continued and is marked as failed, next publish replaces it.
+func loadState() {
+	data, err := ioutil.ReadFile(stateFileName())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Can't read state: %s", err.Error())
+		}
+		return
+	}
+	var state controllerState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		log.Printf("Can't parse state: %s", err.Error())
+		return
+	}
+	serversLock.Lock()
+	for _, node := range state.Nodes {
+		info := &ServerInfo{
+			LastSeenTime:         node.LastSeenTime,
+			LastConfReceivedTime: node.LastConfReceivedTime,
+			CurentConfVersion:    node.CurrentVersion,
+			ReceivedConfVersion:  node.ReceivedVersion,
+			Group:                node.Group,
+			Labels:               node.Labels,
+			Addr:                 node.Addr,
+			LastReportTime:       node.LastReportTime,
+			LastReloadTime:       node.LastReloadTime,
+			ConfHash:             node.ConfHash,
+			ConfTestOk:           node.ConfTestOk,
+			ConfTestOutput:       node.ConfTestOutput,
+		}
+		if node.LastError != "" {
+			info.LastErr = errors.New(node.LastError)
+		}
+		serversState[node.Node] = info
+	}
+	serversLock.Unlock()
+
+	rolloutLock.Lock()
+	rollout = &rolloutState{
+		Version:       state.Rollout.Version,
+		StableVersion: state.Rollout.StableVersion,
+		Wave:          state.Rollout.Wave,
+		WavesCount:    state.Rollout.Waves,
+		Status:        state.Rollout.Status,
+		Started:       state.Rollout.Started,
+		Allowed:       make(map[string]bool),
+		FailedNodes:   state.Rollout.FailedNodes,
+		cancel:        make(chan struct{}),
+	}
+	for _, host := range state.Allowed {
+		rollout.Allowed[host] = true
+	}
+	if rollout.Status == "" {
+		rollout.Status = rolloutDone
+	}
+	if rollout.Status == rolloutRunning {
+		log.Printf("Rollout of version %d was interrupted by restart.", rollout.Version)
+		rollout.Status = rolloutFailed
+	}
+	rolloutLock.Unlock()
+	log.Printf("State loaded: %d nodes, rollout version: %d", len(state.Nodes), state.Rollout.Version)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Node status in /status JSON format.
+type nodeStatus struct {
+	Node                 string            `json:"node"`
+	Group                string            `json:"group"`
+	Labels               map[string]string `json:"labels"`
+	Addr                 string            `json:"addr"`
+	LastSeenTime         int64             `json:"last_seen_time"`
+	LastConfReceivedTime int64             `json:"last_conf_received_time"`
+	CurrentVersion       int               `json:"current_version"`
+	ReceivedVersion      int               `json:"received_version"`
+	TargetVersion        int               `json:"target_version"`
+	LastError            string            `json:"last_error"`
+	LastReportTime       int64             `json:"last_report_time"`
+	LastReloadTime       int64             `json:"last_reload_time"`
+	ConfHash             string            `json:"conf_hash"`
+	ConfTestOk           bool              `json:"conf_test_ok"`
+	ConfTestOutput       string            `json:"conf_test_output"`
+}
+
+// Rollout status in /status JSON format.
+type rolloutStatus struct {
+	Version       int      `json:"version"`
+	StableVersion int      `json:"stable_version"`
+	Status        string   `json:"status"`
+	Wave          int      `json:"wave"`
+	Waves         int      `json:"waves"`
+	Started       int64    `json:"started"`
+	AllowedNodes  int      `json:"allowed_nodes"`
+	FailedNodes   []string `json:"failed_nodes"`
+}
+
+// /status JSON format.
+type statusResponse struct {
+	ConsulVersion int           `json:"consul_version"`
+	Rollout       rolloutStatus `json:"rollout"`
+	Nodes         []nodeStatus  `json:"nodes"`
+}
+
+// Get status format from 'format' param or Accept header: plain, json or prom.
+func statusFormat(r *http.Request) string {
+	switch format := r.URL.Query().Get("format"); format {
+	case "plain", "json", "prom":
+		return format
+	}
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, "application/json"):
+		return "json"
+	case strings.Contains(accept, "application/openmetrics-text"), strings.Contains(accept, "version=0.0.4"):
+		return "prom"
+	}
+	return "plain"
+}
+
+// Collect status of all registered nodes, sorted by node.
+func getNodesStatus() []nodeStatus {
+	serversLock.RLock()
+	defer serversLock.RUnlock()
+	nodes := make([]nodeStatus, 0, len(serversState))
+	for host, state := range serversState {
+		node := nodeStatus{
+			Node:                 host,
+			Group:                state.Group,
+			Labels:               state.Labels,
+			Addr:                 state.Addr,
+			LastSeenTime:         state.LastSeenTime,
+			LastConfReceivedTime: state.LastConfReceivedTime,
+			CurrentVersion:       state.CurentConfVersion,
+			ReceivedVersion:      state.ReceivedConfVersion,
+			TargetVersion:        nodeTargetVersion(host),
+			LastReportTime:       state.LastReportTime,
+			LastReloadTime:       state.LastReloadTime,
+			ConfHash:             state.ConfHash,
+			ConfTestOk:           state.ConfTestOk,
+			ConfTestOutput:       state.ConfTestOutput,
+		}
+		if state.LastErr != nil {
+			node.LastError = state.LastErr.Error()
+		}
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Node < nodes[j].Node })
+	return nodes
+}
+
+// Get rollout status.
+func getRolloutStatusData() rolloutStatus {
+	rolloutLock.Lock()
+	defer rolloutLock.Unlock()
+	return rolloutStatus{
+		Version:       rollout.Version,
+		StableVersion: rollout.StableVersion,
+		Status:        rollout.Status,
+		Wave:          rollout.Wave,
+		Waves:         rollout.WavesCount,
+		Started:       rollout.Started,
+		AllowedNodes:  len(rollout.Allowed),
+		FailedNodes:   rollout.FailedNodes,
+	}
+}
+
+// Return nodes status in prometheus text exposition format.
+func getServersStatusProm(consulVersion int) string {
+	var result strings.Builder
+	now := time.Now().Unix()
+	nodes := getNodesStatus()
+	writeMetric := func(name, help string, value func(node nodeStatus) int64) {
+		fmt.Fprintf(&result, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+		for _, node := range nodes {
+			fmt.Fprintf(&result, "%s{node=%q,group=%q} %d\n", name, node.Node, node.Group, value(node))
+		}
+	}
+	fmt.Fprintf(&result, "# HELP lb_controller_config_version Config version in consul.\n# TYPE lb_controller_config_version gauge\n")
+	fmt.Fprintf(&result, "lb_controller_config_version %d\n", consulVersion)
+	fmt.Fprintf(&result, "# HELP lb_controller_nodes Registered nodes count.\n# TYPE lb_controller_nodes gauge\n")
+	fmt.Fprintf(&result, "lb_controller_nodes %d\n", len(nodes))
+	writeMetric("lb_node_current_config_version", "Config version loaded by node.", func(node nodeStatus) int64 {
+		return int64(node.CurrentVersion)
+	})
+	writeMetric("lb_node_received_config_version", "Last config version received by node.", func(node nodeStatus) int64 {
+		return int64(node.ReceivedVersion)
+	})
+	writeMetric("lb_node_target_config_version", "Config version node is allowed to load.", func(node nodeStatus) int64 {
+		return int64(node.TargetVersion)
+	})
+	writeMetric("lb_node_config_version_lag", "Consul config version minus loaded version.", func(node nodeStatus) int64 {
+		return int64(consulVersion - node.CurrentVersion)
+	})
+	writeMetric("lb_node_last_seen_seconds", "Seconds since node was seen.", func(node nodeStatus) int64 {
+		return now - node.LastSeenTime
+	})
+	writeMetric("lb_node_error", "1 if node has error.", func(node nodeStatus) int64 {
+		if node.LastError != "" {
+			return 1
+		}
+		return 0
+	})
+	return result.String()
+}
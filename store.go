@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+var storeType = flag.String("store.type",
+	getEnv("STORE_TYPE", "local"),
+	"Versions files storage: 'local' (conf.pkg.dir only) or 's3' (S3-compatible storage, conf.pkg.dir is a cache).")
+
+var s3Endpoint = flag.String("s3.endpoint",
+	getEnv("S3_ENDPOINT", ""),
+	"S3 endpoint in format 'host:port'.")
+
+var s3Bucket = flag.String("s3.bucket",
+	getEnv("S3_BUCKET", ""),
+	"S3 bucket for versions files.")
+
+var s3Prefix = flag.String("s3.prefix",
+	getEnv("S3_PREFIX", ""),
+	"Objects names prefix in S3 bucket.")
+
+var s3Region = flag.String("s3.region",
+	getEnv("S3_REGION", ""),
+	"S3 region.")
+
+var s3AccessKey = flag.String("s3.access.key",
+	getEnv("S3_ACCESS_KEY", ""),
+	"S3 access key.")
+
+var s3SecretKey = flag.String("s3.secret.key",
+	getEnv("S3_SECRET_KEY", ""),
+	"S3 secret key.")
+
+var s3Secure = flag.Bool("s3.secure",
+	getEnv("S3_SECURE", "true") == "true",
+	"Use https for S3 requests.")
+
+var storeRedirect = flag.Bool("store.redirect",
+	getEnv("STORE_REDIRECT", "false") == "true",
+	"Redirect /getconf to presigned store url instead of sending package from controller.")
+
+var storeUrlExpiry = flag.Int64("store.url.expiry",
+	getEnvInt64("STORE_URL_EXPIRY", 300),
+	"Seconds presigned store urls are valid.")
+
+// Stored file info.
+type storeFileInfo struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+// Storage of versions files: packages, manifests, signatures and versions info.
+// Files are addressed by local path in conf.pkg.dir, local dir is a working copy.
+type PackageStore interface {
+	// Upload local file to store.
+	Put(path string) error
+	// Open stored file.
+	Open(path string) (io.ReadCloser, error)
+	// Stored file info, not exist error if file is missing.
+	Stat(path string) (storeFileInfo, error)
+	// List files of dir, not recursive.
+	List(dir string) ([]storeFileInfo, error)
+	// Delete stored file.
+	Delete(path string) error
+	// Presigned download url, empty if store has no urls.
+	DownloadUrl(path string, expiry time.Duration) (string, error)
+}
+
+// Versions files storage.
+var packageStore PackageStore = localPackageStore{}
+
+// Local dir storage, files are stored in conf.pkg.dir only.
+type localPackageStore struct{}
+
+func (localPackageStore) Put(path string) error {
+	return nil
+}
+
+func (localPackageStore) Open(path string) (io.ReadCloser, error) {
+	return os.Open(path)
+}
+
+func (localPackageStore) Stat(path string) (storeFileInfo, error) {
+	file, err := os.Stat(path)
+	if err != nil {
+		return storeFileInfo{}, err
+	}
+	return storeFileInfo{Path: path, Size: file.Size(), ModTime: file.ModTime()}, nil
+}
+
+func (localPackageStore) List(dir string) ([]storeFileInfo, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var list []storeFileInfo
+	for _, file := range files {
+		if !file.IsDir() {
+			list = append(list, storeFileInfo{Path: filepath.Join(dir, file.Name()), Size: file.Size(), ModTime: file.ModTime()})
+		}
+	}
+	return list, nil
+}
+
+func (localPackageStore) Delete(path string) error {
+	return os.Remove(path)
+}
+
+func (localPackageStore) DownloadUrl(path string, expiry time.Duration) (string, error) {
+	return "", nil
+}
+
+// S3-compatible storage, object name is path relative to conf.pkg.dir with prefix.
+type s3PackageStore struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+// Create S3 store and check bucket.
+func newS3PackageStore() (*s3PackageStore, error) {
+	client, err := minio.New(*s3Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(*s3AccessKey, *s3SecretKey, ""),
+		Secure: *s3Secure,
+		Region: *s3Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+	exists, err := client.BucketExists(context.Background(), *s3Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("S3 bucket %s doesn't exist", *s3Bucket)
+	}
+	prefix := strings.Trim(*s3Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &s3PackageStore{client: client, bucket: *s3Bucket, prefix: prefix}, nil
+}
+
+// Object name of local path.
+func (s *s3PackageStore) object(path string) string {
+	rel, err := filepath.Rel(*configsPkgsDir, path)
+	if err != nil || rel == "." {
+		return s.prefix
+	}
+	return s.prefix + filepath.ToSlash(rel)
+}
+
+// Convert missing object error to not exist error.
+func s3Error(path string, err error) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+	}
+	return err
+}
+
+func (s *s3PackageStore) Put(path string) error {
+	_, err := s.client.FPutObject(context.Background(), s.bucket, s.object(path), path, minio.PutObjectOptions{})
+	return err
+}
+
+func (s *s3PackageStore) Open(path string) (io.ReadCloser, error) {
+	obj, err := s.client.GetObject(context.Background(), s.bucket, s.object(path), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, s3Error(path, err)
+	}
+	// Request is sent on first read or stat.
+	if _, err = obj.Stat(); err != nil {
+		obj.Close()
+		return nil, s3Error(path, err)
+	}
+	return obj, nil
+}
+
+func (s *s3PackageStore) Stat(path string) (storeFileInfo, error) {
+	obj, err := s.client.StatObject(context.Background(), s.bucket, s.object(path), minio.StatObjectOptions{})
+	if err != nil {
+		return storeFileInfo{}, s3Error(path, err)
+	}
+	return storeFileInfo{Path: path, Size: obj.Size, ModTime: obj.LastModified}, nil
+}
+
+func (s *s3PackageStore) List(dir string) ([]storeFileInfo, error) {
+	prefix := s.object(dir)
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	var list []storeFileInfo
+	for obj := range s.client.ListObjects(context.Background(), s.bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		// Sub dirs (groups) are listed separately.
+		if strings.HasSuffix(obj.Key, "/") {
+			continue
+		}
+		list = append(list, storeFileInfo{Path: filepath.Join(dir, strings.TrimPrefix(obj.Key, prefix)), Size: obj.Size, ModTime: obj.LastModified})
+	}
+	return list, nil
+}
+
+func (s *s3PackageStore) Delete(path string) error {
+	return s.client.RemoveObject(context.Background(), s.bucket, s.object(path), minio.RemoveObjectOptions{})
+}
+
+func (s *s3PackageStore) DownloadUrl(path string, expiry time.Duration) (string, error) {
+	u, err := s.client.PresignedGetObject(context.Background(), s.bucket, s.object(path), expiry, url.Values{})
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+// Set up versions files storage from flags.
+func initPackageStore() {
+	switch *storeType {
+	case "local":
+		log.Printf("Versions files are stored in %s", *configsPkgsDir)
+	case "s3":
+		store, err := newS3PackageStore()
+		if err != nil {
+			log.Fatalf("Can't init S3 store: %s", err.Error())
+		}
+		packageStore = store
+		log.Printf("Versions files are stored in S3 bucket %s, prefix '%s'", store.bucket, store.prefix)
+	default:
+		log.Fatalf("Unknown store type: %s", *storeType)
+	}
+}
+
+// Upload local files to store, missing files (like signatures when signing is disabled) are skipped.
+func storeFiles(paths ...string) error {
+	for _, path := range paths {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
+		if err := packageStore.Put(path); err != nil {
+			log.Printf("Can't store %s: %s", path, err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+// Check that file is stored without download, local copy is checked first.
+func isStored(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	_, err := packageStore.Stat(path)
+	return err
+}
+
+// Copy stored version markers (bad, pinned) and last good version file to conf.pkg.dir.
+// Markers are checked on every /getconf, local copies are checked then.
+func loadVersionMarkers() error {
+	files, err := packageStore.List(*configsPkgsDir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := filepath.Base(file.Path)
+		if name != lastGoodFileName && !strings.HasSuffix(name, ".bad") && !strings.HasSuffix(name, ".pinned") {
+			continue
+		}
+		if err = ensureLocal(file.Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Download stored file to local working copy if it's missing.
+func ensureLocal(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	src, err := packageStore.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	err = os.MkdirAll(filepath.Dir(path), os.FileMode(0755))
+	if err != nil {
+		return err
+	}
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err = io.Copy(tmpFile, src); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err = tmpFile.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmpFile.Name(), os.FileMode(0644)); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), path)
+}
+
+// Delete file from store and local working copy.
+func deleteStoredFile(path string) error {
+	err := packageStore.Delete(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	forgetPackageEtag(path)
+	// zstd package is remembered as missing while gzip package of the version is stored.
+	if strings.HasSuffix(path, packageExts[formatGzip]) {
+		forgetMissingPackage(strings.TrimSuffix(path, packageExts[formatGzip]) + packageExts[formatZstd])
+	}
+	return nil
+}
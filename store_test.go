@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// S3 stand-in: one bucket, objects in memory, requests are not authenticated.
+// Object requests are logged as 'method key'.
+type testS3 struct {
+	bucket   string
+	lock     sync.Mutex
+	objects  map[string][]byte
+	requests []string
+}
+
+// S3 ListObjectsV2 response.
+type testS3List struct {
+	XMLName        xml.Name `xml:"ListBucketResult"`
+	Name           string
+	Prefix         string
+	KeyCount       int
+	MaxKeys        int
+	IsTruncated    bool
+	Contents       []testS3Object
+	CommonPrefixes []testS3Prefix
+}
+
+type testS3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+}
+
+type testS3Prefix struct {
+	Prefix string
+}
+
+// Modification time of all objects.
+var testS3Time = time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+
+func (s *testS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	bucket, key := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		bucket, key = path[:i], path[i+1:]
+	}
+	if bucket != s.bucket {
+		s.error(w, r, 404, "NoSuchBucket")
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if key != "" {
+		s.requests = append(s.requests, r.Method+" "+key)
+	}
+	switch {
+	case key == "" && r.Method == http.MethodHead:
+	case key == "" && r.Method == http.MethodGet:
+		s.list(w, r.URL.Query())
+	case r.Method == http.MethodPut:
+		data, err := readS3Body(r)
+		if err != nil {
+			s.error(w, r, 400, "IncompleteBody")
+			return
+		}
+		s.objects[key] = data
+		w.Header().Set("ETag", `"etag"`)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		data, ok := s.objects[key]
+		if !ok {
+			s.error(w, r, 404, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Last-Modified", testS3Time.Format(http.TimeFormat))
+		w.Header().Set("ETag", `"etag"`)
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case r.Method == http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s.error(w, r, 405, "MethodNotAllowed")
+	}
+}
+
+// Objects of prefix, keys under delimiter are listed as common prefixes.
+func (s *testS3) list(w http.ResponseWriter, query url.Values) {
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	result := testS3List{Name: s.bucket, Prefix: prefix, MaxKeys: 1000}
+	prefixes := make(map[string]bool)
+	var keys []string
+	for key := range s.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			sub := key[:len(prefix)+i+1]
+			if !prefixes[sub] {
+				prefixes[sub] = true
+				result.CommonPrefixes = append(result.CommonPrefixes, testS3Prefix{sub})
+			}
+			continue
+		}
+		result.Contents = append(result.Contents, testS3Object{
+			Key: key, LastModified: testS3Time.Format("2006-01-02T15:04:05.000Z"), ETag: `"etag"`, Size: int64(len(s.objects[key])),
+		})
+	}
+	result.KeyCount = len(result.Contents) + len(result.CommonPrefixes)
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+func (s *testS3) error(w http.ResponseWriter, r *http.Request, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+	}
+}
+
+// Object data of PUT request, streaming signature body is 'size;chunk-signature=...' chunks.
+func readS3Body(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return ioutil.ReadAll(r.Body)
+	}
+	var data []byte
+	br := bufio.NewReader(r.Body)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.ParseInt(strings.SplitN(strings.TrimSpace(line), ";", 2)[0], 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return data, nil
+		}
+		chunk := make([]byte, size+2)
+		if _, err = io.ReadFull(br, chunk); err != nil {
+			return nil, err
+		}
+		data = append(data, chunk[:size]...)
+	}
+}
+
+// Start S3 stand-in and set S3 flags for it.
+func newTestS3(t *testing.T) *testS3 {
+	s3 := &testS3{bucket: "lb-configs", objects: make(map[string][]byte)}
+	server := httptest.NewServer(s3)
+	t.Cleanup(server.Close)
+	flags := []*string{s3Endpoint, s3Bucket, s3Prefix, s3Region, s3AccessKey, s3SecretKey}
+	oldFlags := make([]string, len(flags))
+	for i, flag := range flags {
+		oldFlags[i] = *flag
+	}
+	oldSecure := *s3Secure
+	*s3Endpoint, *s3Bucket, *s3Prefix, *s3Region = strings.TrimPrefix(server.URL, "http://"), s3.bucket, "/lb/", "us-east-1"
+	*s3AccessKey, *s3SecretKey, *s3Secure = "access", "secret", false
+	t.Cleanup(func() {
+		for i, flag := range flags {
+			*flag = oldFlags[i]
+		}
+		*s3Secure = oldSecure
+	})
+	return s3
+}
+
+func (s *testS3) object(key string) ([]byte, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	data, ok := s.objects[key]
+	return data, ok
+}
+
+func TestS3PackageStore(t *testing.T) {
+	dir := testPkgsDir(t)
+	s3 := newTestS3(t)
+	store, err := newS3PackageStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{"5.tar.gz": "package 5", "5.tar.gz.sig": "key1:sig", "public/5.tar.gz": "public package 5"}
+	writeTestFiles(t, dir, files)
+	for name := range files {
+		if err = store.Put(filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Objects are named by path relative to conf.pkg.dir with prefix.
+	for name, data := range files {
+		if stored, ok := s3.object("lb/" + name); !ok || string(stored) != data {
+			t.Fatalf("object lb/%s: %q, %v", name, stored, ok)
+		}
+	}
+
+	info, err := store.Stat(filepath.Join(dir, "5.tar.gz"))
+	if err != nil || info.Size != 9 || !info.ModTime.Equal(testS3Time) {
+		t.Fatalf("stat %+v, %v", info, err)
+	}
+
+	src, err := store.Open(filepath.Join(dir, "public/5.tar.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(src)
+	src.Close()
+	if err != nil || string(data) != "public package 5" {
+		t.Fatalf("opened data %q, %v", data, err)
+	}
+
+	// Group subdir is not listed with files of dir.
+	list, err := store.List(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var listed []string
+	for _, file := range list {
+		listed = append(listed, fmt.Sprintf("%s %d", file.Path, file.Size))
+		if !file.ModTime.Equal(testS3Time) {
+			t.Fatalf("%s time %s", file.Path, file.ModTime)
+		}
+	}
+	want := []string{filepath.Join(dir, "5.tar.gz") + " 9", filepath.Join(dir, "5.tar.gz.sig") + " 8"}
+	if strings.Join(listed, ", ") != strings.Join(want, ", ") {
+		t.Fatalf("listed %v, want %v", listed, want)
+	}
+	if list, err = store.List(filepath.Join(dir, "public")); err != nil || len(list) != 1 {
+		t.Fatalf("group dir list %v, %v", list, err)
+	}
+
+	pkgUrl, err := store.DownloadUrl(filepath.Join(dir, "5.tar.gz"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(pkgUrl)
+	if err != nil || u.Path != "/lb-configs/lb/5.tar.gz" || u.Query().Get("X-Amz-Signature") == "" || u.Query().Get("X-Amz-Expires") != "60" {
+		t.Fatalf("download url %s, %v", pkgUrl, err)
+	}
+	resp, err := http.Get(pkgUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(data) != "package 5" {
+		t.Fatalf("downloaded %q", data)
+	}
+
+	if err = store.Delete(filepath.Join(dir, "5.tar.gz")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s3.object("lb/5.tar.gz"); ok {
+		t.Fatal("object is not deleted")
+	}
+	if _, err = store.Open(filepath.Join(dir, "5.tar.gz")); !os.IsNotExist(err) {
+		t.Fatalf("open of deleted object: %v", err)
+	}
+}
+
+func TestS3PackageStoreNoBucket(t *testing.T) {
+	newTestS3(t)
+	*s3Bucket = "missing"
+	if _, err := newS3PackageStore(); err == nil {
+		t.Fatal("store with missing bucket is created")
+	}
+}
+
+// Missing file is not exist error for all stores, ensureLocal callers rely on it.
+func TestPackageStoreOpenMissing(t *testing.T) {
+	dir := testPkgsDir(t)
+	newTestS3(t)
+	s3Store, err := newS3PackageStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, store := range map[string]PackageStore{"local": localPackageStore{}, "s3": s3Store} {
+		if _, err := store.Open(filepath.Join(dir, "1.tar.zst")); !os.IsNotExist(err) {
+			t.Fatalf("%s: open of missing file: %v", name, err)
+		}
+		if _, err := store.Stat(filepath.Join(dir, "1.tar.zst")); !os.IsNotExist(err) {
+			t.Fatalf("%s: stat of missing file: %v", name, err)
+		}
+	}
+}
+
+func TestEnsureLocal(t *testing.T) {
+	dir := testPkgsDir(t)
+	newTestS3(t)
+	store, err := newS3PackageStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldStore := packageStore
+	packageStore = store
+	t.Cleanup(func() { packageStore = oldStore })
+	name := filepath.Join(dir, "7.tar.gz")
+	writeTestFiles(t, dir, map[string]string{"7.tar.gz": "package 7"})
+	if err = storeFiles(name, signatureFile(name)); err != nil {
+		t.Fatal(err)
+	}
+	// Local copy is removed (other controller instance, cleaned cache), it's downloaded again.
+	os.Remove(name)
+	if err = ensureLocal(name); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(name); err != nil || string(data) != "package 7" {
+		t.Fatalf("local copy %q, %v", data, err)
+	}
+	if err = deleteStoredFile(name); err != nil {
+		t.Fatal(err)
+	}
+	if err = ensureLocal(name); !os.IsNotExist(err) {
+		t.Fatalf("ensureLocal of deleted file: %v", err)
+	}
+}
+
+// Redirect to store doesn't download package and doesn't look up signature with signing disabled.
+func TestStoreRedirectS3(t *testing.T) {
+	dir := testPkgsDir(t)
+	s3 := newTestS3(t)
+	store, err := newS3PackageStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldStore, oldRedirect := packageStore, *storeRedirect
+	packageStore, *storeRedirect = store, true
+	rolloutLock.Lock()
+	oldRollout := rollout
+	rollout = &rolloutState{Version: 2, Status: rolloutDone}
+	rolloutLock.Unlock()
+	t.Cleanup(func() {
+		packageStore, *storeRedirect = oldStore, oldRedirect
+		rolloutLock.Lock()
+		rollout = oldRollout
+		rolloutLock.Unlock()
+		serversLock.Lock()
+		delete(serversState, "192.0.2.3")
+		serversLock.Unlock()
+	})
+	testPublishVersion(t, 2, map[string]string{"a.conf": "a"})
+	gzipName, zstdName := packageFileName(*defaultGroup, 2, formatGzip), packageFileName(*defaultGroup, 2, formatZstd)
+	if err = storeFiles(gzipName, zstdName); err != nil {
+		t.Fatal(err)
+	}
+	// Other controller instance: packages are in store only.
+	os.Remove(gzipName)
+	os.Remove(zstdName)
+	s3.lock.Lock()
+	s3.requests = nil
+	s3.lock.Unlock()
+
+	r := httptest.NewRequest("GET", "/getconf?ver=2&format=zstd", nil)
+	r.RemoteAddr = "192.0.2.3:1234"
+	w := httptest.NewRecorder()
+	sendConfHandler(w, r)
+	if w.Code != 302 || !strings.Contains(w.Header().Get("Location"), "/lb-configs/lb/2.tar.zst?") {
+		t.Fatalf("status %d, location %s", w.Code, w.Header().Get("Location"))
+	}
+	if _, err = os.Stat(zstdName); !os.IsNotExist(err) {
+		t.Fatalf("package is downloaded to %s", dir)
+	}
+	s3.lock.Lock()
+	requests := s3.requests
+	s3.lock.Unlock()
+	if strings.Join(requests, ", ") != "HEAD lb/2.tar.zst" {
+		t.Fatalf("store requests: %v", requests)
+	}
+}
+
+// Bad, pinned and last good markers are stored, new controller instance loads them from store.
+func TestVersionMarkersStored(t *testing.T) {
+	dir := testPkgsDir(t)
+	s3 := newTestS3(t)
+	store, err := newS3PackageStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldStore := packageStore
+	packageStore = store
+	t.Cleanup(func() { packageStore = oldStore })
+	testRolloutFlags(t, 0, 0, 0)
+	writeTestFiles(t, groupDir(dir, *defaultGroup), map[string]string{"4.tar.gz": "package 4"})
+	if err = storeFiles(filepath.Join(groupDir(dir, *defaultGroup), "4.tar.gz")); err != nil {
+		t.Fatal(err)
+	}
+
+	markVersionBad(5, "failed")
+	setLastGoodVersion(4)
+	w := httptest.NewRecorder()
+	pinVersionHandler(w, testRoleRequest("PUT", "/versions/4/pin", roleOperator, map[string]string{"version": "4"}))
+	if w.Code != 204 {
+		t.Fatalf("pin status %d: %s", w.Code, w.Body.String())
+	}
+	for _, name := range []string{"5.bad", "4.pinned", lastGoodFileName} {
+		if _, ok := s3.object("lb/" + name); !ok {
+			t.Fatalf("%s is not stored", name)
+		}
+	}
+
+	// New instance with empty conf.pkg.dir.
+	for _, name := range []string{"5.bad", "4.pinned", lastGoodFileName} {
+		os.Remove(filepath.Join(dir, name))
+	}
+	lastGoodLock.Lock()
+	lastGoodVersion = 0
+	lastGoodLock.Unlock()
+	if err = loadVersionMarkers(); err != nil {
+		t.Fatal(err)
+	}
+	loadLastGoodVersion()
+	if !isVersionBad(5) || isVersionBad(4) || !isVersionPinned(4) || getLastGoodVersion() != 4 {
+		t.Fatalf("bad: %v, pinned: %v, last good: %d", isVersionBad(5), isVersionPinned(4), getLastGoodVersion())
+	}
+
+	w = httptest.NewRecorder()
+	pinVersionHandler(w, testRoleRequest("DELETE", "/versions/4/pin", roleOperator, map[string]string{"version": "4"}))
+	if w.Code != 204 {
+		t.Fatalf("unpin status %d", w.Code)
+	}
+	if _, ok := s3.object("lb/4.pinned"); ok || isVersionPinned(4) {
+		t.Fatal("unpinned version marker is kept")
+	}
+}
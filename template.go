@@ -1,45 +1,49 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 	"text/template"
+	"time"
 )
 
-//type projectsMetadataType map[string]*projectMetadata
-
 // Generate virtual hosts config from consul metadata.
-// Use consul-template binary (shell command).
+// Main template is rendered once per node group with the group's projects only.
+// ssl/non ssl vhost templates are available in main template by their file names.
 func genConfig(projectsMetadata projectsMetadataType) (Error error) {
-	log.Println(*projectsMetadata["c9b8b104b9e54599add63fcfb652d810"].Domains["test-ssl-acme.horoshop.ua"])
-	return nil
-}
-
-func testTmpl() {
-	domains := make(map[string]*projectDomainData)
-	domains["example1.com"] = &projectDomainData{false, 0}
-	domains["example2.com"] = &projectDomainData{true, 1}
-	domains2 := make(map[string]*projectDomainData)
-	domains2["example21.com"] = &projectDomainData{false, 0}
-	domains2["example22.com"] = &projectDomainData{false, 0}
-
-	projects := make(projectsMetadataType)
-	projects["UUID111"] = &projectMetadata{domains, "nfs1", "2.4.4", "radis::cache", "redis::sessions", "DbMasterUrl", "DbSlaveUrl", "LogUrl", "core_path", "0", "front", "root"}
-	projects["UUID111"].Domains = domains
-	projects["UUID222"] = &projectMetadata{domains2, "nfs2", "2.4.4", "radis::cache", "redis::sessions", "DbMasterUrl", "DbSlaveUrl", "LogUrl", "core_path", "0", "front", "root"}
-
-	var tpl string = `{{ range $key, $value := . }}
-	UUID {{ $key }} {{ .Storage }}
-	{{ $storage := .Storage -}}
-	server_name {{ range $key, $_ := .Domains -}}{{ $key }} {{ $key }}. {{ end -}}
-{{ end }}
-`
-	tmpl, err := template.New("test").Parse(tpl)
-	if err != nil {
-		log.Fatal(err)
+	if projectsMetadata == nil {
+		return fmt.Errorf("Projects metadata is empty, check consul data")
 	}
-	err = tmpl.Execute(os.Stdout, projects)
+	defer observeStage(stageRender, time.Now())
+	tmpl, err := template.ParseFiles(*vHostsTemplateFile, *vhostsSslTmpl, *vhostsNonSslTmpl)
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("Can't parse templates: %s", err.Error())
+		return err
 	}
+	// Output file name is the main template name without '.tmpl' suffix.
+	confName := strings.TrimSuffix(filepath.Base(*vHostsTemplateFile), ".tmpl")
+	for _, group := range nodeGroupNames() {
+		groupConfDir := groupDir(*configsDir, group)
+		err = os.MkdirAll(groupConfDir, os.FileMode(0755))
+		if err != nil {
+			log.Println(err.Error())
+			return err
+		}
+		confFile, err := os.Create(filepath.Join(groupConfDir, confName))
+		if err != nil {
+			log.Println(err.Error())
+			return err
+		}
+		err = tmpl.ExecuteTemplate(confFile, filepath.Base(*vHostsTemplateFile), projectsForGroup(projectsMetadata, group))
+		confFile.Close()
+		if err != nil {
+			log.Printf("Can't render config for group %s: %s", group, err.Error())
+			return err
+		}
+		log.Printf("Config for group %s created: %s", group, confFile.Name())
+	}
+	return nil
 }
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+var tlsCertFile = flag.String("tls.cert",
+	getEnv("TLS_CERT", ""),
+	"Server certificate file. Empty - plain http.")
+
+var tlsKeyFile = flag.String("tls.key",
+	getEnv("TLS_KEY", ""),
+	"Server certificate key file.")
+
+var tlsClientCa = flag.String("tls.client.ca",
+	getEnv("TLS_CLIENT_CA", ""),
+	"CA bundle to verify client certificates. Empty - client certificates are not requested.")
+
+var tlsClientRequire = flag.Bool("tls.client.require",
+	getEnv("TLS_CLIENT_REQUIRE", "false") == "true",
+	"Require client certificate (otherwise verified only if given).")
+
+// Seconds between certificate files change checks.
+const tlsReloadCheckInterval = 10
+
+// Server certificate, reloaded from disk when files are changed.
+type certReloader struct {
+	certFile  string
+	keyFile   string
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+	lock      sync.Mutex
+}
+
+// Load certificate first time.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	reloader := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// Latest modification time of cert and key files.
+func (c *certReloader) filesModTime() (time.Time, error) {
+	certStat, err := os.Stat(c.certFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	keyStat, err := os.Stat(c.keyFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if keyStat.ModTime().After(certStat.ModTime()) {
+		return keyStat.ModTime(), nil
+	}
+	return certStat.ModTime(), nil
+}
+
+// Read certificate and key from disk.
+func (c *certReloader) reload() error {
+	modTime, err := c.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.cert = &cert
+	c.modTime = modTime
+	log.Printf("TLS certificate loaded: %s", c.certFile)
+	return nil
+}
+
+// tls.Config GetCertificate callback. Files are checked not often than tlsReloadCheckInterval,
+// broken new files are logged and old certificate is kept.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if time.Since(c.lastCheck) < tlsReloadCheckInterval*time.Second {
+		return c.cert, nil
+	}
+	c.lastCheck = time.Now()
+	modTime, err := c.filesModTime()
+	if err == nil && modTime.After(c.modTime) {
+		err = c.reload()
+	}
+	if err != nil {
+		log.Printf("Can't reload TLS certificate: %s", err.Error())
+	}
+	return c.cert, nil
+}
+
+// Return true if listener should use TLS.
+func tlsEnabled() bool {
+	return *tlsCertFile != ""
+}
+
+// Build listener TLS config.
+func serverTlsConfig() (*tls.Config, error) {
+	reloader, err := newCertReloader(*tlsCertFile, *tlsKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if *tlsClientCa != "" {
+		pool, err := loadCertPool(*tlsClientCa)
+		if err != nil {
+			return nil, err
+		}
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+		if *tlsClientRequire {
+			conf.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return conf, nil
+}
+
+// Read CA bundle.
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("No certificates found in %s", caFile)
+	}
+	return pool, nil
+}
+
+// Node identity and address. Identity is client certificate CN (or first SAN) if node sent verified
+// certificate, otherwise node ip. Address is always node ip, used to request /config_version.
+func nodeIdentity(r *http.Request) (id string, addr string) {
+	addr, _, _ = net.SplitHostPort(r.RemoteAddr)
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		cert := r.TLS.VerifiedChains[0][0]
+		if cert.Subject.CommonName != "" {
+			return cert.Subject.CommonName, addr
+		}
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0], addr
+		}
+	}
+	return addr, addr
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var watchTimeout = flag.Int64("watch.timeout",
+	getEnvInt64("WATCH_TIMEOUT", 60),
+	"Max seconds /watch request waits for new config version.")
+
+// Channel closed on every target version change. Watchers wait on it and check their target again.
+var versionWatchCh = make(chan struct{})
+var versionWatchLock sync.Mutex
+
+// Get channel to wait for next target version change.
+func versionWatchChan() <-chan struct{} {
+	versionWatchLock.Lock()
+	defer versionWatchLock.Unlock()
+	return versionWatchCh
+}
+
+// Wake up all watchers (new version published or rollout wave started).
+func notifyVersionWatchers() {
+	versionWatchLock.Lock()
+	defer versionWatchLock.Unlock()
+	close(versionWatchCh)
+	versionWatchCh = make(chan struct{})
+}
+
+// Response of /watch endpoint.
+type watchResponse struct {
+	Version int    `json:"version"`
+	Url     string `json:"url"`
+}
+
+// Endpoint for nodes to wait for config version newer than 'ver'.
+// Responds with new version and package url, or 204 after timeout.
+// Request example: http://controller-host:8081/watch?ver=12345&timeout=30
+func watchHandler(w http.ResponseWriter, r *http.Request) {
+	ver, err := strconv.Atoi(r.URL.Query().Get("ver"))
+	if err != nil {
+		http.Error(w, "Missing version number.", 400)
+		return
+	}
+	timeout := *watchTimeout
+	if t, err := strconv.ParseInt(r.URL.Query().Get("timeout"), 10, 64); err == nil && t > 0 && t < timeout {
+		timeout = t
+	}
+	nodeID, _ := nodeIdentity(r)
+	serversLock.Lock()
+	if state, ok := serversState[nodeID]; ok {
+		state.LastSeenTime = time.Now().Unix()
+	}
+	serversLock.Unlock()
+
+	timer := time.NewTimer(time.Duration(timeout) * time.Second)
+	defer timer.Stop()
+	for {
+		// Get channel before target check to not miss a change between check and wait.
+		changed := versionWatchChan()
+		if target := nodeTargetVersion(nodeID); target > ver {
+			w.Header().Set("Content-Type", "application/json")
+			err = json.NewEncoder(w).Encode(watchResponse{target, fmt.Sprintf("/getconf?ver=%d", target)})
+			if err != nil {
+				log.Printf("Can't send watch response to %s: %s", nodeID, err.Error())
+			}
+			return
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-shuttingDown:
+			// Node reconnects to restarted controller.
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}